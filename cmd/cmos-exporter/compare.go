@@ -0,0 +1,85 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/compare"
+)
+
+// runCompare implements `cmos-exporter compare`, which compares the metrics of two expositions or series snapshots,
+// such as the exporter's `/metrics` output against a recording from 7.x.
+func runCompare(args []string) int {
+	flags := pflag.NewFlagSet("compare", pflag.ContinueOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	minCoverage := flags.Float64("min_coverage", 0, "fail if the coverage of the base's metrics is below this (0 to 1)")
+	minAccuracy := flags.Float64("min_accuracy", 0, "fail if the fraction of covered metrics with matching labels is below this (0 to 1)")
+	ignoredLabels := flags.StringSlice("ignore_labels", compare.DefaultIgnoredLabels, "labels to leave out of the comparison")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compare [flags] <base> <target>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Compares the metrics of target against base. Each is a Prometheus text exposition, or the JSON")
+		fmt.Fprintln(os.Stderr, "response of Prometheus' /api/v1/series.")
+		fmt.Fprintln(os.Stderr)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	base, err := compare.Load(flags.Arg(0), *ignoredLabels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	target, err := compare.Load(flags.Arg(1), *ignoredLabels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result := compare.Compare(base, target)
+
+	switch *format {
+	case "text":
+		err = result.WriteText(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if result.Coverage() < *minCoverage || result.Accuracy() < *minAccuracy {
+		fmt.Fprintf(os.Stderr, "Coverage %.4f or accuracy %.4f is below the minimum (%.4f, %.4f)\n", result.Coverage(),
+			result.Accuracy(), *minCoverage, *minAccuracy)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,252 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/config"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// runDump implements `cmos-exporter dump`, which collects the metrics once and prints them, instead of serving them.
+// It takes the same flags and configuration as the exporter.
+func runDump(args []string) int {
+	flags := pflag.CommandLine
+	format := flags.String("format", "text", "output format: text (Prometheus), openmetrics, or json")
+	selected := flags.StringSlice("collectors", nil, "collectors to run, of "+strings.Join(collectorNames, ", ")+
+		" (default all)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dump [flags]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Collects the metrics once and prints them to stdout. Exits with an error if any collector failed.")
+		fmt.Fprintln(os.Stderr)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	switch *format {
+	case "text", "openmetrics", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return 2
+	}
+	enabled := make(map[string]bool)
+	for _, name := range *selected {
+		if !contains(collectorNames, name) {
+			fmt.Fprintf(os.Stderr, "Unknown collector %q\n", name)
+			return 2
+		}
+		enabled[name] = true
+	}
+
+	cfg, err := config.Read(*flagConfigPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Collect once, now, rather than serving whatever a background collection had got to.
+	cfg.BackgroundInterval, cfg.BackgroundIntervals = 0, nil
+	logger := newLogger(cfg)
+	defer logger.Sync()
+
+	exp, err := newExporter(cfg, logger, func(collector string) bool {
+		return len(enabled) == 0 || enabled[collector]
+	})
+	if err != nil {
+		logger.Error("Failed to start exporter", zap.Error(err))
+		return 1
+	}
+	defer exp.Close()
+
+	mfs, gatherErr := exp.gatherer.Gather()
+	if err := writeMetrics(os.Stdout, *format, mfs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := false
+	if gatherErr != nil {
+		logger.Error("Some metrics could not be gathered", zap.Error(gatherErr))
+		failed = true
+	}
+	// The collectors report their errors to CollectionErrors as they collect. Gather it separately, as it is collected
+	// at the same time as the collectors.
+	errorCounts, err := gatherCounts(common.CollectionErrors)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for collector, count := range errorCounts {
+		if count > 0 {
+			logger.Error("Collector failed", zap.String("collector", collector), zap.Float64("errors", count))
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes mfs to w in the given format.
+func writeMetrics(w io.Writer, format string, mfs []*dto.MetricFamily) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jsonFamilies(mfs))
+	}
+	expFormat := expfmt.FmtText
+	if format == "openmetrics" {
+		expFormat = expfmt.FmtOpenMetrics
+	}
+	enc := expfmt.NewEncoder(w, expFormat)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// gatherCounts returns the values of vec, keyed by the value of its only label.
+func gatherCounts(vec *prometheus.CounterVec) (map[string]float64, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(vec)
+	mfs, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, metric := range mf.Metric {
+			counts[metric.Label[0].GetValue()] = metric.Counter.GetValue()
+		}
+	}
+	return counts, nil
+}
+
+// jsonFamily is a metric family in the JSON output of dump. Histograms and summaries are expanded into samples like
+// in the text format, so every sample has a single value.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Samples []jsonSample `json:"samples"`
+}
+
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	// Value is a string, as JSON has no NaN or infinities.
+	Value string `json:"value"`
+}
+
+func jsonFamilies(mfs []*dto.MetricFamily) []jsonFamily {
+	families := make([]jsonFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		family := jsonFamily{
+			Name:    mf.GetName(),
+			Help:    mf.GetHelp(),
+			Type:    strings.ToLower(mf.GetType().String()),
+			Samples: []jsonSample{},
+		}
+		for _, metric := range mf.Metric {
+			labels := make(map[string]string, len(metric.Label))
+			for _, pair := range metric.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			sample := func(suffix string, value float64, extra ...string) {
+				sampleLabels := labels
+				if len(extra) > 0 {
+					sampleLabels = make(map[string]string, len(labels)+1)
+					for name, value := range labels {
+						sampleLabels[name] = value
+					}
+					sampleLabels[extra[0]] = extra[1]
+				}
+				family.Samples = append(family.Samples, jsonSample{
+					Name:   family.Name + suffix,
+					Labels: sampleLabels,
+					Value:  formatValue(value),
+				})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				sample("", metric.Counter.GetValue())
+			case dto.MetricType_GAUGE:
+				sample("", metric.Gauge.GetValue())
+			case dto.MetricType_HISTOGRAM:
+				buckets := metric.Histogram.Bucket
+				for _, bucket := range buckets {
+					sample("_bucket", float64(bucket.GetCumulativeCount()), "le", formatValue(bucket.GetUpperBound()))
+				}
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+					sample("_bucket", float64(metric.Histogram.GetSampleCount()), "le", "+Inf")
+				}
+				sample("_sum", metric.Histogram.GetSampleSum())
+				sample("_count", float64(metric.Histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				for _, quantile := range metric.Summary.Quantile {
+					sample("", quantile.GetValue(), "quantile", formatValue(quantile.GetQuantile()))
+				}
+				sample("_sum", metric.Summary.GetSampleSum())
+				sample("_count", float64(metric.Summary.GetSampleCount()))
+			default:
+				sample("", metric.Untyped.GetValue())
+			}
+		}
+		families = append(families, family)
+	}
+	return families
+}
+
+// formatValue formats v like the text format does.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/config"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/background"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/eventing"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/fts"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/gsi"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/jsonapi"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/memcached"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/n1ql"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/system"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/xdcr"
+)
+
+// collectorNames are the names of the collectors, in the order they are created.
+var collectorNames = []string{"system", "xdcr", "memcached", "gsi", "n1ql", "fts", "eventing", "jsonapi"}
+
+// exporter is the collectors for a node, registered with a registry.
+type exporter struct {
+	registry *prometheus.Registry
+	// gatherer is registry, wrapped to record each scrape if configured.
+	gatherer prometheus.Gatherer
+	// wrap wraps a gatherer in the same way as gatherer.
+	wrap       func(prometheus.Gatherer) prometheus.Gatherer
+	collectors []common.Collector
+	closers    []io.Closer
+}
+
+// newExporter connects to the node (or starts replaying a recorded scrape), and registers a collector for each of its
+// services, if enabled returns true for the collector's name and the configuration doesn't disable it. Close must be
+// called to stop it.
+func newExporter(cfg *config.Config, logger *zap.Logger, enabled func(collector string) bool) (*exporter, error) {
+	e := &exporter{}
+	if err := e.setup(cfg, logger, enabled); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *exporter) setup(cfg *config.Config, logger *zap.Logger, selected func(collector string) bool) error {
+	for name := range cfg.Collectors {
+		if !contains(collectorNames, name) {
+			return fmt.Errorf("unknown collector %q in collectors (known collectors are %s)", name,
+				strings.Join(collectorNames, ", "))
+		}
+	}
+	for name, interval := range cfg.BackgroundIntervals {
+		if !contains(collectorNames, name) {
+			return fmt.Errorf("unknown collector %q in background_intervals (known collectors are %s)", name,
+				strings.Join(collectorNames, ", "))
+		}
+		if interval < 0 {
+			return fmt.Errorf("negative background interval for %s", name)
+		}
+	}
+	if cfg.BackgroundInterval < 0 {
+		return fmt.Errorf("negative background interval")
+	}
+	if err := cfg.CheckRecord(); err != nil {
+		return err
+	}
+	enabled := func(collector string) bool {
+		return selected(collector) && cfg.CollectorEnabled(collector)
+	}
+	metricFilter, err := common.NewFilter(cfg.MetricsInclude, cfg.MetricsExclude)
+	if err != nil {
+		return fmt.Errorf("invalid metrics filter: %w", err)
+	}
+	bucketFilter, err := common.NewFilter(cfg.BucketsInclude, cfg.BucketsExclude)
+	if err != nil {
+		return fmt.Errorf("invalid buckets filter: %w", err)
+	}
+
+	// When replaying, the node is a fake one serving a recorded scrape, see pkg/couchbase/recording.
+	var node couchbase.NodeCommon
+	var replay *fake.Cluster
+	if cfg.Replay != "" {
+		replay, err = fake.StartClusterFS(os.DirFS(cfg.Replay))
+		if err != nil {
+			return fmt.Errorf("failed to start replay of %s: %w", cfg.Replay, err)
+		}
+		e.closers = append(e.closers, closerFunc(replay.Close))
+		logger.Info("Replaying recorded scrape", zap.String("dir", cfg.Replay), zap.String("version", replay.Version))
+		node = replay.Node
+	} else {
+		bootstrapped, err := couchbase.BootstrapNode(logger.Sugar(), cfg.CouchbaseHost, cfg.CouchbaseUsername,
+			cfg.CouchbasePassword, cfg.CouchbaseManagementPort)
+		if err != nil {
+			return fmt.Errorf("failed to bootstrap cluster: %w", err)
+		}
+		node = bootstrapped
+	}
+
+	ms := metrics.LoadDefaultMetricSet()
+	if cfg.MetricSet != "" {
+		ms, err = metrics.LoadMetricSet(cfg.MetricSet)
+		if err != nil {
+			return fmt.Errorf("failed to load metric set %s: %w", cfg.MetricSet, err)
+		}
+	}
+	// Filter the metrics before creating the collectors, so that they don't request stats just to drop them.
+	if metricFilter != nil {
+		ms = ms.Filter(metricFilter.Allowed)
+	}
+
+	if enabled("system") {
+		sys := system.NewSystemMetrics(logger.Named("system").Sugar(), ms.System)
+		e.closers = append(e.closers, sys)
+		e.collectors = append(e.collectors, sys)
+	}
+
+	if enabled("xdcr") {
+		// The XDCR REST API is only reachable from the node itself, or from the fake cluster if it has XDCR payloads.
+		xdcrReachable := replay != nil && replay.XDCRPort != 0
+		if replay == nil {
+			nodeIP := net.ParseIP(cfg.CouchbaseHost)
+			if nodeIP == nil {
+				ips, err := net.LookupIP(cfg.CouchbaseHost)
+				if err != nil {
+					return fmt.Errorf("failed to look up the IP of %s: %w", cfg.CouchbaseHost, err)
+				}
+				if len(ips) == 0 {
+					return fmt.Errorf("found no IPs for %s", cfg.CouchbaseHost)
+				}
+				nodeIP = ips[0]
+			}
+			xdcrReachable = nodeIP.IsLoopback()
+			if !xdcrReachable {
+				logger.Warn("Node hostname is not loopback - XDCR metrics are only available when running on localhost")
+			}
+		}
+		if xdcrReachable {
+			xdcrColl, err := xdcr.NewXDCRMetrics(logger.Named("xdcr").Sugar(), node, ms.XDCR)
+			if err != nil {
+				return fmt.Errorf("failed to create XDCR collector: %w", err)
+			}
+			if replay != nil {
+				xdcrColl.RESTPort = replay.XDCRPort
+			}
+			e.collectors = append(e.collectors, xdcrColl)
+		}
+	}
+
+	// The other collectors are only created if the node runs their service.
+	hasService := func(collector string, service cbrest.Service) (bool, error) {
+		if !enabled(collector) {
+			return false, nil
+		}
+		has, err := node.HasService(service)
+		if err != nil {
+			return false, fmt.Errorf("failed to check for the %s service: %w", collector, err)
+		}
+		return has, nil
+	}
+
+	if has, err := hasService("memcached", cbrest.ServiceData); err != nil {
+		return err
+	} else if has {
+		mc, err := memcached.NewMemcachedMetrics(logger.Named("memcached"), node, ms.Memcached)
+		if err != nil {
+			return fmt.Errorf("failed to create memcached collector: %w", err)
+		}
+		e.closers = append(e.closers, mc)
+		mc.BucketSeriesLimit = cfg.KVBucketSeriesLimit
+		mc.SeriesLimit = cfg.KVSeriesLimit
+		// TODO: we need to add scope/collection labels to the various metrics
+		// mc.FakeCollections = cfg.FakeCollections
+		e.collectors = append(e.collectors, mc)
+	}
+
+	if has, err := hasService("gsi", cbrest.ServiceGSI); err != nil {
+		return err
+	} else if has {
+		gsiCollector, err := gsi.NewMetrics(logger.Sugar().Named("gsi"), node, ms.GSI, cfg.FakeCollections,
+			cfg.GSIAggregatePartitions)
+		if err != nil {
+			return fmt.Errorf("failed to create GSI collector: %w", err)
+		}
+		e.collectors = append(e.collectors, gsiCollector)
+	}
+
+	if has, err := hasService("n1ql", cbrest.ServiceQuery); err != nil {
+		return err
+	} else if has {
+		n1qlCollector, err := n1ql.NewMetrics(logger.Sugar().Named("n1ql"), node, ms.N1QL, cfg.N1QLPreparedsLimit)
+		if err != nil {
+			return fmt.Errorf("failed to create N1QL collector: %w", err)
+		}
+		e.collectors = append(e.collectors, n1qlCollector)
+	}
+
+	if has, err := hasService("fts", cbrest.ServiceSearch); err != nil {
+		return err
+	} else if has {
+		e.collectors = append(e.collectors, fts.NewCollector(logger.Sugar().Named("fts"), node, ms.FTS,
+			cfg.FTSPIndexStats))
+	}
+
+	if has, err := hasService("eventing", cbrest.ServiceEventing); err != nil {
+		return err
+	} else if has {
+		eventingCollector, err := eventing.NewCollector(logger.Sugar().Named("eventing"), node, ms.Eventing)
+		if err != nil {
+			return fmt.Errorf("failed to create Eventing collector: %w", err)
+		}
+		e.collectors = append(e.collectors, eventingCollector)
+	}
+
+	if enabled("jsonapi") {
+		jsonAPICollector, err := jsonapi.NewCollector(logger.Sugar().Named("jsonapi"), node, ms.JSONAPI)
+		if err != nil {
+			return fmt.Errorf("failed to create JSON API collector: %w", err)
+		}
+		if !jsonAPICollector.Empty() {
+			e.collectors = append(e.collectors, jsonAPICollector)
+		}
+	}
+
+	for i, collector := range e.collectors {
+		if interval := cfg.CollectorInterval(collector.Name()); interval > 0 {
+			bc := background.NewCollector(logger.Sugar().Named("background"), collector, interval)
+			e.closers = append(e.closers, bc)
+			e.collectors[i] = bc
+			logger.Info("Collecting in the background", zap.String("collector", collector.Name()),
+				zap.Duration("interval", interval))
+		}
+	}
+
+	e.registry = prometheus.NewPedanticRegistry()
+	e.registry.MustRegister(common.InvalidMetrics, common.CollectionErrors)
+	for _, collector := range e.collectors {
+		collector.SetBucketFilter(bucketFilter)
+		if err := e.registry.Register(collector); err != nil {
+			return fmt.Errorf("failed to register %s collector: %w", collector.Name(), err)
+		}
+		logger.Info("Registered collector", zap.String("collector", collector.Name()))
+	}
+
+	e.wrap = func(g prometheus.Gatherer) prometheus.Gatherer { return g }
+	if cfg.Record != "" {
+		recorder, err := recording.NewRecorder(logger.Sugar().Named("recording"), cfg.Record, node,
+			cfg.RecordMaxScrapes)
+		if err != nil {
+			return fmt.Errorf("failed to start recording to %s: %w", cfg.Record, err)
+		}
+		for _, collector := range e.collectors {
+			collector.SetRecorder(recorder)
+		}
+		e.wrap = recorder.Gatherer
+		logger.Info("Recording scrapes", zap.String("dir", cfg.Record), zap.Int("maxScrapes", cfg.RecordMaxScrapes))
+	}
+	e.gatherer = e.wrap(e.registry)
+	return nil
+}
+
+// handler serves the metrics of all the collectors or, like node_exporter, only those of the collectors named by the
+// request's `collect[]` parameters, so that separate Prometheus jobs can scrape them at different intervals. Named
+// collectors that aren't running on this node are ignored, so that the same jobs can scrape every node.
+func (e *exporter) handler(opts promhttp.HandlerOpts) http.Handler {
+	all := promhttp.HandlerFor(e.gatherer, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["collect[]"]
+		if len(names) == 0 {
+			all.ServeHTTP(w, r)
+			return
+		}
+		for _, name := range names {
+			if !contains(collectorNames, name) {
+				http.Error(w, fmt.Sprintf("unknown collector %q (known collectors are %s)", name,
+					strings.Join(collectorNames, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+		registry, err := e.filteredRegistry(names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(e.wrap(registry), opts).ServeHTTP(w, r)
+	})
+}
+
+// filteredRegistry returns a registry of only the named collectors, and the self-metrics.
+func (e *exporter) filteredRegistry(names []string) (*prometheus.Registry, error) {
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(common.InvalidMetrics); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(common.CollectionErrors); err != nil {
+		return nil, err
+	}
+	for _, collector := range e.collectors {
+		if !contains(names, collector.Name()) {
+			continue
+		}
+		if err := registry.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register %s collector: %w", collector.Name(), err)
+		}
+	}
+	return registry, nil
+}
+
+// Close stops the collectors, and the replay of a recorded scrape if any.
+func (e *exporter) Close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		_ = e.closers[i].Close()
+	}
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/config"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// families returns the names of the metric families that the handler serves for the given query.
+func families(t *testing.T, handler http.Handler, query string) []string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics"+query, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(rec.Body)
+	require.NoError(t, err)
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// hasPrefix returns whether any of names starts with prefix.
+func hasPrefix(names []string, prefix string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandlerCollect(t *testing.T) {
+	// Replay the fake cluster's payloads. The system collector is left out, as it reads the machine's stats.
+	exp, err := newExporter(&config.Config{Replay: "../../pkg/couchbase/fake/testdata/6.6.0"}, zap.NewNop(),
+		func(collector string) bool { return collector != "system" })
+	require.NoError(t, err)
+	defer exp.Close()
+	handler := exp.handler(promhttp.HandlerOpts{})
+	// The self-metrics are only served once they have a series.
+	common.CollectionErrors.WithLabelValues("memcached").Add(0)
+
+	all := families(t, handler, "")
+	for _, prefix := range []string{"kv_", "index_", "n1ql_", "fts_", "eventing_", "xdcr_"} {
+		require.True(t, hasPrefix(all, prefix), "no %s metrics in %v", prefix, all)
+	}
+
+	memcached := families(t, handler, "?collect[]=memcached")
+	require.True(t, hasPrefix(memcached, "kv_"))
+	for _, name := range memcached {
+		require.True(t, strings.HasPrefix(name, "kv_") || strings.HasPrefix(name, "cmos_exporter_"),
+			"%s isn't a memcached or self-metric", name)
+	}
+	// The self-metrics are served with any collectors.
+	require.Contains(t, memcached, "cmos_exporter_collection_errors_total")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics?collect[]=memcached&collect[]=nope", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), `unknown collector "nope"`)
+}
@@ -18,30 +18,19 @@ package main
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
 
 	goutilslog "github.com/couchbase/goutils/logging"
-	"github.com/couchbase/tools-common/cbrest"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/meta"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/config"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/eventing"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/fts"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/gsi"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/memcached"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/n1ql"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/system"
-	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/xdcr"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/remotewrite"
 )
 
 var (
@@ -72,7 +61,31 @@ func processBuildInfo() map[string]string {
 	return result
 }
 
+// newLogger builds the logger for cfg, which logs to stderr, and sets up the memcached client's logging to use it.
+func newLogger(cfg *config.Config) *zap.Logger {
+	logCfg := zap.NewProductionConfig()
+	logCfg.Level = zap.NewAtomicLevelAt(cfg.LogLevel.ToZap())
+	logCfg.Encoding = "console"
+	logger, _ := logCfg.Build()
+	goutilslog.SetLogger(&config.GoUtilsZapLogger{Logger: logger.WithOptions(zap.AddCallerSkip(2)).Named(
+		"memcached").Sugar()})
+	return logger
+}
+
+// subcommands are the alternatives to running the exporter, chosen by the first argument. Each returns the exit code.
+var subcommands = map[string]func(args []string) int{
+	"compare":          runCompare,
+	"dump":             runDump,
+	"validate-metrics": runValidateMetrics,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
 	buildInfo := processBuildInfo()
 	pflag.Parse()
 
@@ -91,120 +104,46 @@ func main() {
 	}
 
 	// From this point on, we should switch to using Zap for logging.
-	logCfg := zap.NewProductionConfig()
-	logCfg.Level = zap.NewAtomicLevelAt(cfg.LogLevel.ToZap())
-	logCfg.Encoding = "console"
-	logger, _ := logCfg.Build()
+	logger := newLogger(cfg)
 	defer logger.Sync()
 
 	logger.Info("Started & configured logging", zap.String("version", meta.Version), zap.Any("buildInfo", buildInfo))
 	// using zap.Object ensures we don't leak any sensitive fields, as the ObjectMarshaller will redact them
 	logger.Debug("Loaded configuration", zap.Object("cfg", cfg))
 
-	goutilslog.SetLogger(&config.GoUtilsZapLogger{Logger: logger.WithOptions(zap.AddCallerSkip(2)).Named(
-		"memcached").Sugar()})
-
-	node, err := couchbase.BootstrapNode(logger.Sugar(), cfg.CouchbaseHost, cfg.CouchbaseUsername, cfg.CouchbasePassword,
-		cfg.CouchbaseManagementPort)
-	if err != nil {
-		logger.Sugar().Fatalw("Failed to bootstrap cluster", "err", err)
-	}
-
-	ms := metrics.LoadDefaultMetricSet()
-	reg := prometheus.NewPedanticRegistry()
-
-	sys := system.NewSystemMetrics(logger.Named("system").Sugar(), ms.System)
-	reg.MustRegister(sys)
-	logger.Info("Registered system collector")
-
-	nodeIP := net.ParseIP(cfg.CouchbaseHost)
-	if nodeIP == nil {
-		ips, err := net.LookupIP(cfg.CouchbaseHost)
-		if err != nil {
-			logger.Fatal("Failed to look up the host IP", zap.String("host", cfg.CouchbaseHost), zap.Error(err))
-		}
-		if len(ips) == 0 {
-			logger.Fatal("Found no IPs for host", zap.String("host", cfg.CouchbaseHost))
-		}
-		nodeIP = ips[0]
-	}
-	if nodeIP != nil && nodeIP.IsLoopback() {
-		xdcrColl, err := xdcr.NewXDCRMetrics(logger.Named("xdcr").Sugar(), node, ms.XDCR)
-		if err != nil {
-			logger.Sugar().Fatalw("Failed to create XDCR collector", "err", err)
-		}
-		reg.MustRegister(xdcrColl)
-		logger.Info("Registered XDCR collector")
-	} else {
-		logger.Warn("Node hostname is not loopback - XDCR metrics are only available when running on localhost")
-	}
-
-	hasKV, err := node.HasService(cbrest.ServiceData)
+	exp, err := newExporter(cfg, logger, func(string) bool { return true })
 	if err != nil {
-		logger.Sugar().Fatalw("Failed to check KV", "err", err)
-	}
-	if hasKV {
-		mc, err := memcached.NewMemcachedMetrics(logger.Named("memcached"), node, ms.Memcached)
+		logger.Sugar().Fatalw("Failed to start exporter", "err", err)
+	}
+	defer exp.Close()
+
+	if cfg.RemoteWriteURL != "" {
+		pusher, err := remotewrite.NewPusher(logger.Sugar().Named("remotewrite"), exp.gatherer, remotewrite.Config{
+			URL:            cfg.RemoteWriteURL,
+			Interval:       cfg.RemoteWriteInterval,
+			Timeout:        cfg.RemoteWriteTimeout,
+			Username:       cfg.RemoteWriteUsername,
+			Password:       cfg.RemoteWritePassword,
+			ExternalLabels: cfg.RemoteWriteExternalLabels,
+			QueueSize:      cfg.RemoteWriteQueueSize,
+			Retries:        cfg.RemoteWriteRetries,
+		})
 		if err != nil {
-			logger.Sugar().Fatalw("Failed to create memcached collector", "err", err)
+			logger.Sugar().Fatalw("Failed to start remote write", "err", err)
 		}
-		defer mc.Close()
-		// TODO: we need to add scope/collection labels to the various metrics
-		// mc.FakeCollections = cfg.FakeCollections
-		reg.MustRegister(mc)
-		logger.Info("Registered memcached collector")
-	}
-
-	hasGSI, err := node.HasService(cbrest.ServiceGSI)
-	if err != nil {
-		logger.Sugar().Fatalw("Failed to check GSI", "err", err)
-	}
-	if hasGSI {
-		gsiCollector, err := gsi.NewMetrics(logger.Sugar().Named("gsi"), node, ms.GSI, cfg.FakeCollections)
-		if err != nil {
-			logger.Sugar().Fatalw("Failed to create GSI collector", "err", err)
-		}
-		reg.MustRegister(gsiCollector)
-		logger.Info("Registered GSI collector")
-	}
-
-	hasN1QL, err := node.HasService(cbrest.ServiceQuery)
-	if err != nil {
-		logger.Sugar().Fatalw("Failed to check N1QL", "err", err)
-	}
-	if hasN1QL {
-		n1qlCollector, err := n1ql.NewMetrics(logger.Sugar().Named("n1ql"), node, ms.N1QL)
-		if err != nil {
-			logger.Sugar().Fatalw("Failed to create N1QL collector", "err", err)
-		}
-		reg.MustRegister(n1qlCollector)
-		logger.Info("Registered N1QL collector")
-	}
-
-	hasFTS, err := node.HasService(cbrest.ServiceSearch)
-	if err != nil {
-		logger.Sugar().Fatalw("Failed to check FTS", "err", err)
-	}
-	if hasFTS {
-		ftsCollector := fts.NewCollector(logger.Sugar().Named("fts"), node, ms.FTS, cfg.FakeCollections)
-		reg.MustRegister(ftsCollector)
-		logger.Info("Registered FTS collector")
-	}
-
-	hasEventing, err := node.HasService(cbrest.ServiceEventing)
-	if err != nil {
-		logger.Sugar().Fatalw("Failed to check Eventing", "err", err)
-	}
-	if hasEventing {
-		eventingCollector, err := eventing.NewCollector(logger.Sugar().Named("eventing"), node, ms.Eventing)
-		if err != nil {
-			logger.Sugar().Fatalw("Failed to create Eventing collector", "err", err)
-		}
-		reg.MustRegister(eventingCollector)
-		logger.Info("Registered Eventing collector")
-	}
-
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		defer pusher.Close()
+		// Its self-metrics are pushed along with the others, as well as being served.
+		exp.registry.MustRegister(pusher)
+		logger.Info("Pushing metrics with remote write", zap.String("url", cfg.RemoteWriteURL),
+			zap.Duration("interval", cfg.RemoteWriteInterval))
+	}
+
+	// Carry on if some metrics are invalid, so that one bad stat doesn't fail the whole scrape. The errors are logged,
+	// and counted by common.InvalidMetrics.
+	http.Handle("/metrics", exp.handler(promhttp.HandlerOpts{
+		ErrorLog:      zap.NewStdLog(logger.Named("promhttp")),
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
 	logger.Info("HTTP server starting", zap.String("address", cfg.Bind))
 	log.Fatal(http.ListenAndServe(cfg.Bind, nil))
 }
@@ -0,0 +1,91 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// runValidateMetrics implements `cmos-exporter validate-metrics`, which checks a metric set without connecting to
+// Couchbase Server, and reports every problem with it.
+func runValidateMetrics(args []string) int {
+	flags := pflag.NewFlagSet("validate-metrics", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate-metrics <file>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Checks a metric set, in the format of pkg/metrics/defaultMetricSet.json, and reports each problem")
+		fmt.Fprintln(os.Stderr, "with the JSON path of the value at fault.")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	val, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, err = metrics.ParseMetricSet(val)
+	if err == nil {
+		fmt.Printf("%s: OK\n", path)
+		return 0
+	}
+
+	var problems common.ValidationErrors
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &problems):
+		for _, problem := range problems {
+			fmt.Printf("%s: %v\n", path, problem)
+		}
+		fmt.Fprintf(os.Stderr, "Found %d problems\n", len(problems))
+	case errors.As(err, &syntaxErr):
+		line, col := position(val, syntaxErr.Offset)
+		fmt.Printf("%s:%d:%d: %v\n", path, line, col, syntaxErr)
+	case errors.As(err, &typeErr):
+		line, col := position(val, typeErr.Offset)
+		fmt.Printf("%s:%d:%d: .%s: cannot use a JSON %s as a %s\n", path, line, col, typeErr.Field, typeErr.Value,
+			typeErr.Type)
+	default:
+		fmt.Printf("%s: %v\n", path, err)
+	}
+	return 1
+}
+
+// position returns the line and column of the byte at offset in data, counting from 1.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
@@ -0,0 +1,310 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package compare compares the metrics of two Prometheus expositions, to check the exporter's parity with the metrics
+// that Couchbase Server 7.x exposes natively.
+package compare
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefaultIgnoredLabels are the labels that Prometheus adds to every series it scrapes, so aren't part of either side.
+var DefaultIgnoredLabels = []string{"job", "instance"}
+
+// Snapshot is the metrics of an exposition as Prometheus would store them, mapping each series name to the names of
+// its labels (across all of its series). Histograms and summaries are expanded into their `_bucket`, `_sum` and
+// `_count` series.
+type Snapshot map[string]map[string]bool
+
+func (s Snapshot) add(name string, labels []string) {
+	set, ok := s[name]
+	if !ok {
+		set = make(map[string]bool)
+		s[name] = set
+	}
+	for _, label := range labels {
+		set[label] = true
+	}
+}
+
+// Labels returns the sorted label names of the given series name.
+func (s Snapshot) Labels(name string) []string {
+	return sortedKeys(s[name])
+}
+
+// Load reads a snapshot from the file at path. See Parse for the supported formats.
+func Load(path string, ignoredLabels []string) (Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	snapshot, err := Parse(file, ignoredLabels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// Parse reads a snapshot from r, which is either a Prometheus text exposition (such as the output of `/metrics`), or
+// the JSON response of Prometheus' `/api/v1/series` (or just its `data` array), as captured from a 7.x cluster.
+// ignoredLabels are left out of the label names.
+func Parse(r io.Reader, ignoredLabels []string) (Snapshot, error) {
+	br := bufio.NewReader(r)
+	first, err := firstNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	ignored := make(map[string]bool, len(ignoredLabels))
+	for _, label := range ignoredLabels {
+		ignored[label] = true
+	}
+	if first == '{' || first == '[' {
+		return parseSeries(br, ignored)
+	}
+	return parseExposition(br, ignored)
+}
+
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for i := 1; ; i++ {
+		peeked, err := br.Peek(i)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if c := peeked[i-1]; !strings.ContainsRune(" \t\r\n", rune(c)) {
+			return c, nil
+		}
+	}
+}
+
+func parseExposition(r io.Reader, ignored map[string]bool) (Snapshot, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(Snapshot)
+	for name, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				if !ignored[pair.GetName()] {
+					labels = append(labels, pair.GetName())
+				}
+			}
+			switch family.GetType() {
+			case dto.MetricType_HISTOGRAM:
+				snapshot.add(name+"_bucket", append(labels, "le"))
+				snapshot.add(name+"_sum", labels)
+				snapshot.add(name+"_count", labels)
+			case dto.MetricType_SUMMARY:
+				snapshot.add(name, append(labels, "quantile"))
+				snapshot.add(name+"_sum", labels)
+				snapshot.add(name+"_count", labels)
+			default:
+				snapshot.add(name, labels)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+func parseSeries(r io.Reader, ignored map[string]bool) (Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var series []map[string]string
+	if err := json.Unmarshal(data, &series); err != nil {
+		var response struct {
+			Status string              `json:"status"`
+			Data   []map[string]string `json:"data"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, err
+		}
+		if response.Status != "success" {
+			return nil, fmt.Errorf("series response has status %q", response.Status)
+		}
+		series = response.Data
+	}
+	snapshot := make(Snapshot)
+	for _, labelSet := range series {
+		name, ok := labelSet["__name__"]
+		if !ok {
+			return nil, fmt.Errorf("series without a name: %v", labelSet)
+		}
+		labels := make([]string, 0, len(labelSet)-1)
+		for label := range labelSet {
+			if label != "__name__" && !ignored[label] {
+				labels = append(labels, label)
+			}
+		}
+		snapshot.add(name, labels)
+	}
+	return snapshot, nil
+}
+
+// LabelDiff is the difference in label names of a metric that both snapshots have.
+type LabelDiff struct {
+	// Missing is the labels that only the base has.
+	Missing []string `json:"missing"`
+	// Extra is the labels that only the target has.
+	Extra []string `json:"extra"`
+}
+
+// Result is the result of comparing a target snapshot (such as the exporter's) against a base one (such as 7.x's).
+type Result struct {
+	// Total is the number of metrics in the base.
+	Total int `json:"total"`
+	// Covered is the number of metrics of the base that the target has.
+	Covered int `json:"covered"`
+	// Accurate is the number of covered metrics that have the same labels in both.
+	Accurate int `json:"accurate"`
+	// Missing is the metrics that only the base has.
+	Missing []string `json:"missing"`
+	// Extra is the metrics that only the target has.
+	Extra []string `json:"extra"`
+	// Mismatched is the covered metrics whose labels differ.
+	Mismatched map[string]LabelDiff `json:"mismatched"`
+}
+
+// Coverage is the fraction of the base's metrics that the target has.
+func (r Result) Coverage() float64 {
+	if r.Total == 0 {
+		return 1
+	}
+	return float64(r.Covered) / float64(r.Total)
+}
+
+// Accuracy is the fraction of the covered metrics that have the same labels in both.
+func (r Result) Accuracy() float64 {
+	if r.Covered == 0 {
+		return 1
+	}
+	return float64(r.Accurate) / float64(r.Covered)
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	type result Result
+	return json.Marshal(struct {
+		result
+		Coverage float64 `json:"coverage"`
+		Accuracy float64 `json:"accuracy"`
+	}{result(r), r.Coverage(), r.Accuracy()})
+}
+
+// Compare compares target against base.
+func Compare(base, target Snapshot) Result {
+	result := Result{
+		Total:      len(base),
+		Missing:    []string{},
+		Extra:      []string{},
+		Mismatched: make(map[string]LabelDiff),
+	}
+	for name, baseLabels := range base {
+		targetLabels, ok := target[name]
+		if !ok {
+			result.Missing = append(result.Missing, name)
+			continue
+		}
+		result.Covered++
+		diff := LabelDiff{
+			Missing: difference(baseLabels, targetLabels),
+			Extra:   difference(targetLabels, baseLabels),
+		}
+		if len(diff.Missing) == 0 && len(diff.Extra) == 0 {
+			result.Accurate++
+			continue
+		}
+		result.Mismatched[name] = diff
+	}
+	for name := range target {
+		if _, ok := base[name]; !ok {
+			result.Extra = append(result.Extra, name)
+		}
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Extra)
+	return result
+}
+
+// WriteText writes a human-readable report of the result to w.
+func (r Result) WriteText(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Coverage: %d/%d (%.2f%%)\n", r.Covered, r.Total, r.Coverage()*100)
+	fmt.Fprintf(&sb, "Accuracy: %d/%d (%.2f%%)\n", r.Accurate, r.Covered, r.Accuracy()*100)
+	if len(r.Mismatched) > 0 {
+		fmt.Fprintf(&sb, "\nLabel mismatches (%d):\n", len(r.Mismatched))
+		names := make([]string, 0, len(r.Mismatched))
+		for name := range r.Mismatched {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			diff := r.Mismatched[name]
+			fmt.Fprintf(&sb, "  %s: missing [%s], extra [%s]\n", name, strings.Join(diff.Missing, ", "),
+				strings.Join(diff.Extra, ", "))
+		}
+	}
+	writeList(&sb, "Missing metrics", r.Missing)
+	writeList(&sb, "Extra metrics", r.Extra)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeList(sb *strings.Builder, title string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "\n%s (%d):\n", title, len(names))
+	for _, name := range names {
+		fmt.Fprintf(sb, "  %s\n", name)
+	}
+}
+
+// difference returns the sorted keys of a that aren't in b.
+func difference(a, b map[string]bool) []string {
+	result := []string{}
+	for key := range a {
+		if !b[key] {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sortedKeys(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for key := range set {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package compare
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const exposition = `# HELP kv_ops Number of operations
+# TYPE kv_ops counter
+kv_ops{bucket="a",op="get"} 1
+kv_ops{bucket="a",op="set",result="hit"} 2
+# TYPE kv_cmd_duration_seconds histogram
+kv_cmd_duration_seconds_bucket{bucket="a",le="1"} 1
+kv_cmd_duration_seconds_bucket{bucket="a",le="+Inf"} 1
+kv_cmd_duration_seconds_sum{bucket="a"} 0.5
+kv_cmd_duration_seconds_count{bucket="a"} 1
+# TYPE index_items_count gauge
+index_items_count{bucket="a",index="i"} 3
+# TYPE n1ql_extra gauge
+n1ql_extra 1
+`
+
+const series = `{"status": "success", "data": [
+	{"__name__": "kv_ops", "bucket": "a", "op": "get", "result": "hit", "instance": "node1", "job": "couchbase"},
+	{"__name__": "kv_cmd_duration_seconds_bucket", "bucket": "a", "le": "1", "instance": "node1", "job": "couchbase"},
+	{"__name__": "kv_cmd_duration_seconds_sum", "bucket": "a", "instance": "node1", "job": "couchbase"},
+	{"__name__": "kv_cmd_duration_seconds_count", "bucket": "a", "instance": "node1", "job": "couchbase"},
+	{"__name__": "index_items_count", "bucket": "a", "scope": "_default", "collection": "_default", "index": "i"},
+	{"__name__": "fts_doc_count", "bucket": "a", "index": "f"}
+]}`
+
+func TestParse(t *testing.T) {
+	snapshot, err := Parse(strings.NewReader(exposition), DefaultIgnoredLabels)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 6)
+	require.Equal(t, []string{"bucket", "op", "result"}, snapshot.Labels("kv_ops"))
+	require.Equal(t, []string{"bucket", "le"}, snapshot.Labels("kv_cmd_duration_seconds_bucket"))
+	require.Equal(t, []string{"bucket"}, snapshot.Labels("kv_cmd_duration_seconds_count"))
+	require.Empty(t, snapshot.Labels("n1ql_extra"))
+
+	snapshot, err = Parse(strings.NewReader(series), DefaultIgnoredLabels)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 6)
+	require.Equal(t, []string{"bucket", "op", "result"}, snapshot.Labels("kv_ops"))
+
+	// a bare array of series works too
+	snapshot, err = Parse(strings.NewReader(`[{"__name__": "up", "job": "x"}]`), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"job"}, snapshot.Labels("up"))
+}
+
+func TestCompare(t *testing.T) {
+	base, err := Parse(strings.NewReader(series), DefaultIgnoredLabels)
+	require.NoError(t, err)
+	target, err := Parse(strings.NewReader(exposition), DefaultIgnoredLabels)
+	require.NoError(t, err)
+
+	result := Compare(base, target)
+	require.Equal(t, 6, result.Total)
+	require.Equal(t, 5, result.Covered)
+	require.Equal(t, 4, result.Accurate)
+	require.Equal(t, []string{"fts_doc_count"}, result.Missing)
+	require.Equal(t, []string{"n1ql_extra"}, result.Extra)
+	require.Equal(t, map[string]LabelDiff{
+		"index_items_count": {Missing: []string{"collection", "scope"}, Extra: []string{}},
+	}, result.Mismatched)
+	require.InDelta(t, 5.0/6, result.Coverage(), 1e-9)
+	require.InDelta(t, 4.0/5, result.Accuracy(), 1e-9)
+
+	var sb strings.Builder
+	require.NoError(t, result.WriteText(&sb))
+	require.Contains(t, sb.String(), "Coverage: 5/6 (83.33%)")
+	require.Contains(t, sb.String(), "index_items_count: missing [collection, scope], extra []")
+
+	encoded, err := json.Marshal(result)
+	require.NoError(t, err)
+	require.Contains(t, string(encoded), `"coverage":0.8333333333333334`)
+}
+
+func TestCompareEmpty(t *testing.T) {
+	result := Compare(Snapshot{}, Snapshot{})
+	require.Equal(t, 1.0, result.Coverage())
+	require.Equal(t, 1.0, result.Accuracy())
+}
@@ -16,8 +16,10 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -32,7 +34,83 @@ type Config struct {
 	CouchbaseSSL            bool     `mapstructure:"couchbase_ssl"`
 	Bind                    string   `mapstructure:"bind"`
 	FakeCollections         bool     `mapstructure:"fake_collections"`
+	GSIAggregatePartitions  bool     `mapstructure:"gsi_aggregate_partitions"`
+	N1QLPreparedsLimit      int      `mapstructure:"n1ql_prepareds_limit"`
+	FTSPIndexStats          bool     `mapstructure:"fts_pindex_stats"`
+	MetricSet               string   `mapstructure:"metric_set"`
+	Record                  string   `mapstructure:"record"`
+	RecordMaxScrapes        int      `mapstructure:"record_max_scrapes"`
+	Replay                  string   `mapstructure:"replay"`
 	LogLevel                LogLevel `mapstructure:"log_level"`
+	// Collectors enables or disables each collector by name. Collectors that aren't listed are enabled, if the node
+	// runs their service.
+	Collectors map[string]bool `mapstructure:"collectors"`
+	// MetricsInclude and MetricsExclude are regular expressions over the names of the metrics in the metric set. If
+	// MetricsInclude is set, only the metrics that match it are collected, and any that match MetricsExclude aren't.
+	MetricsInclude []string `mapstructure:"metrics_include"`
+	MetricsExclude []string `mapstructure:"metrics_exclude"`
+	// BucketsInclude and BucketsExclude are the same as MetricsInclude and MetricsExclude, for bucket names.
+	BucketsInclude []string `mapstructure:"buckets_include"`
+	BucketsExclude []string `mapstructure:"buckets_exclude"`
+	// BackgroundInterval is how often to collect in the background, serving the latest metrics on scrape, instead of
+	// collecting on every scrape. Zero (the default) disables background collection.
+	BackgroundInterval time.Duration `mapstructure:"background_interval"`
+	// BackgroundIntervals overrides BackgroundInterval for each collector by name. Zero collects on every scrape.
+	BackgroundIntervals map[string]time.Duration `mapstructure:"background_intervals"`
+	// KVBucketSeriesLimit and KVSeriesLimit are the maximum number of KV series to expose for each bucket, and for all
+	// of them. Zero means no limit.
+	KVBucketSeriesLimit int `mapstructure:"kv_bucket_series_limit"`
+	KVSeriesLimit       int `mapstructure:"kv_series_limit"`
+	// RemoteWriteURL is the remote write endpoint to push the metrics to, if set. See the remotewrite package for the
+	// other RemoteWrite options.
+	RemoteWriteURL            string            `mapstructure:"remote_write_url"`
+	RemoteWriteInterval       time.Duration     `mapstructure:"remote_write_interval"`
+	RemoteWriteTimeout        time.Duration     `mapstructure:"remote_write_timeout"`
+	RemoteWriteUsername       string            `mapstructure:"remote_write_username"`
+	RemoteWritePassword       string            `mapstructure:"remote_write_password"`
+	RemoteWriteExternalLabels map[string]string `mapstructure:"remote_write_external_labels"`
+	RemoteWriteQueueSize      int               `mapstructure:"remote_write_queue_size"`
+	RemoteWriteRetries        int               `mapstructure:"remote_write_retries"`
+}
+
+// CollectorEnabled returns whether the named collector is enabled.
+func (c Config) CollectorEnabled(name string) bool {
+	enabled, ok := c.Collectors[name]
+	return !ok || enabled
+}
+
+// CollectorInterval returns how often to collect the named collector in the background, or zero to collect it on
+// every scrape.
+func (c Config) CollectorInterval(name string) time.Duration {
+	if interval, ok := c.BackgroundIntervals[name]; ok {
+		return interval
+	}
+	return c.BackgroundInterval
+}
+
+// BackgroundCollection returns whether any collector is collected in the background.
+func (c Config) BackgroundCollection() bool {
+	if c.BackgroundInterval > 0 {
+		return true
+	}
+	for _, interval := range c.BackgroundIntervals {
+		if interval > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrRecordBackground is the error for a configuration that enables both recording and background collection.
+var ErrRecordBackground = errors.New("record can't be used with background collection")
+
+// CheckRecord returns ErrRecordBackground if recording is enabled along with background collection. Background
+// collections happen outside of scrapes, so the recorder would drop their responses.
+func (c Config) CheckRecord() error {
+	if c.Record != "" && c.BackgroundCollection() {
+		return ErrRecordBackground
+	}
+	return nil
 }
 
 func init() {
@@ -42,8 +120,30 @@ func init() {
 	pflag.StringP("couchbase_password", "P", "", "password to use")
 	pflag.BoolP("couchbase_ssl", "s", false, "whether to require TLS")
 	pflag.StringP("bind", "b", ":9091", "host:port to serve on")
-	pflag.Bool("fake_collections", false, "whether to add scope/collection labels to metrics that use them")
+	pflag.Bool("fake_collections", false, "whether to add scope/collection labels to metrics that use them (not FTS stats, see fts_index_info)")
+	pflag.Bool("gsi_aggregate_partitions", true, "whether to combine the partitions of partitioned indexes, like 7.x does")
+	pflag.Int("n1ql_prepareds_limit", 100, "maximum number of prepared statements to expose metrics for (0 for no limit)")
+	pflag.Bool("fts_pindex_stats", false, "whether to expose per-pindex (index partition) FTS metrics")
+	pflag.String("metric_set", "", "path to a metric set to use instead of the default one")
+	pflag.String("record", "", "directory to save the raw Couchbase responses of each scrape to")
+	pflag.Int("record_max_scrapes", 100, "maximum number of scrapes to keep in the record directory, deleting the oldest (0 for no limit)")
+	pflag.String("replay", "", "directory of a recorded scrape to serve instead of connecting to Couchbase Server")
 	pflag.StringP("log_level", "l", "info", "level to log at")
+	pflag.StringSlice("metrics_include", nil, "regular expressions of the only metrics to collect")
+	pflag.StringSlice("metrics_exclude", nil, "regular expressions of metrics not to collect")
+	pflag.StringSlice("buckets_include", nil, "regular expressions of the only buckets to collect metrics for")
+	pflag.StringSlice("buckets_exclude", nil, "regular expressions of buckets not to collect metrics for")
+	pflag.Duration("background_interval", 0, "how often to collect in the background instead of on scrape (0 to disable)")
+	pflag.Int("kv_bucket_series_limit", 0, "maximum number of KV series to expose for each bucket (0 for no limit)")
+	pflag.Int("kv_series_limit", 0, "maximum number of KV series to expose for all buckets (0 for no limit)")
+	pflag.String("remote_write_url", "", "remote write endpoint to push the metrics to (leave blank to not push)")
+	pflag.Duration("remote_write_interval", 30*time.Second, "how often to push the metrics")
+	pflag.Duration("remote_write_timeout", 10*time.Second, "timeout of each remote write request")
+	pflag.String("remote_write_username", "", "username to push with (leave blank for no authentication)")
+	pflag.String("remote_write_password", "", "password to push with")
+	pflag.StringToString("remote_write_external_labels", nil, "labels to add to every pushed series")
+	pflag.Int("remote_write_queue_size", 100, "maximum number of remote write requests to queue while the endpoint is down")
+	pflag.Int("remote_write_retries", 3, "how many times to retry a failed remote write request")
 }
 
 func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
@@ -54,7 +154,30 @@ func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddBool("CouchbaseSSL", c.CouchbaseSSL)
 	enc.AddString("Bind", c.Bind)
 	enc.AddBool("FakeCollections", c.FakeCollections)
+	enc.AddBool("GSIAggregatePartitions", c.GSIAggregatePartitions)
+	enc.AddInt("N1QLPreparedsLimit", c.N1QLPreparedsLimit)
+	enc.AddBool("FTSPIndexStats", c.FTSPIndexStats)
+	enc.AddString("MetricSet", c.MetricSet)
+	enc.AddString("Record", c.Record)
+	enc.AddString("Replay", c.Replay)
 	enc.AddString("LogLevel", string(c.LogLevel))
+	_ = enc.AddReflected("Collectors", c.Collectors)
+	_ = enc.AddReflected("MetricsInclude", c.MetricsInclude)
+	_ = enc.AddReflected("MetricsExclude", c.MetricsExclude)
+	_ = enc.AddReflected("BucketsInclude", c.BucketsInclude)
+	_ = enc.AddReflected("BucketsExclude", c.BucketsExclude)
+	enc.AddDuration("BackgroundInterval", c.BackgroundInterval)
+	_ = enc.AddReflected("BackgroundIntervals", c.BackgroundIntervals)
+	enc.AddInt("KVBucketSeriesLimit", c.KVBucketSeriesLimit)
+	enc.AddInt("KVSeriesLimit", c.KVSeriesLimit)
+	enc.AddString("RemoteWriteURL", c.RemoteWriteURL)
+	enc.AddDuration("RemoteWriteInterval", c.RemoteWriteInterval)
+	enc.AddDuration("RemoteWriteTimeout", c.RemoteWriteTimeout)
+	enc.AddString("RemoteWriteUsername", "<ud>"+c.RemoteWriteUsername+"</ud>")
+	enc.AddString("RemoteWritePassword", "[PRIVATE]")
+	_ = enc.AddReflected("RemoteWriteExternalLabels", c.RemoteWriteExternalLabels)
+	enc.AddInt("RemoteWriteQueueSize", c.RemoteWriteQueueSize)
+	enc.AddInt("RemoteWriteRetries", c.RemoteWriteRetries)
 	return nil
 }
 
@@ -63,7 +186,15 @@ func Read(path string) (*Config, error) {
 	viper.SetDefault("couchbase_management_port", 8091)
 	viper.SetDefault("bind", ":9091")
 	viper.SetDefault("fake_collections", true)
+	viper.SetDefault("gsi_aggregate_partitions", true)
+	viper.SetDefault("n1ql_prepareds_limit", 100)
+	viper.SetDefault("fts_pindex_stats", false)
+	viper.SetDefault("record_max_scrapes", 100)
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("remote_write_interval", 30*time.Second)
+	viper.SetDefault("remote_write_timeout", 10*time.Second)
+	viper.SetDefault("remote_write_queue_size", 100)
+	viper.SetDefault("remote_write_retries", 3)
 
 	viper.SetConfigName("cmos-exporter")
 	viper.SetConfigType("yaml")
@@ -100,6 +231,12 @@ func Read(path string) (*Config, error) {
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	if cfg.Record != "" && cfg.Replay != "" {
+		return nil, fmt.Errorf("record and replay can't be used together")
+	}
+	if err := cfg.CheckRecord(); err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
@@ -0,0 +1,58 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRecordBackground(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config string
+		Err    error
+	}{
+		{Name: "record", Config: "record: /tmp/scrapes"},
+		{Name: "background", Config: "background_interval: 1m"},
+		{Name: "record and background", Config: "record: /tmp/scrapes\nbackground_interval: 1m", Err: ErrRecordBackground},
+		{
+			Name:   "record and collector background",
+			Config: "record: /tmp/scrapes\nbackground_intervals:\n  gsi: 1m",
+			Err:    ErrRecordBackground,
+		},
+		// Zero collects on every scrape, so is recorded.
+		{Name: "record and zero interval", Config: "record: /tmp/scrapes\nbackground_intervals:\n  gsi: 0s"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			path := filepath.Join(t.TempDir(), "cmos-exporter.yml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.Config), 0o600))
+			_, err := Read(path)
+			require.ErrorIs(t, err, tc.Err)
+			if tc.Err == nil {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
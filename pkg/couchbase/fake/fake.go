@@ -0,0 +1,173 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package fake is a fake single-node Couchbase Server for testing the collectors without a real cluster. It serves
+// recorded REST payloads for each supported version, and answers the memcached requests that the KV collector makes.
+package fake
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/couchbase/tools-common/cbrest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+)
+
+// The credentials that the fake cluster accepts.
+const (
+	Username = "Administrator"
+	Password = "password"
+)
+
+// payloads holds the synthesized payloads of each version, laid out as `testdata/<version>/<service>/<endpoint>.json`.
+// See testdata/README.md.
+//
+//go:embed testdata
+var payloads embed.FS
+
+// Versions returns the Couchbase Server versions that there are payloads for, in order.
+func Versions() []string {
+	entries, err := payloads.ReadDir("testdata")
+	if err != nil {
+		panic(err)
+	}
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// VersionFS returns the payloads of version.
+func VersionFS(version string) (fs.FS, error) {
+	dir := path.Join("testdata", version)
+	if _, err := fs.Stat(payloads, dir); err != nil {
+		return nil, fmt.Errorf("unknown version %s: %w", version, err)
+	}
+	return fs.Sub(payloads, dir)
+}
+
+// Payload returns the recorded response of the given service's endpoint, and whether there is one.
+func Payload(version, service, endpoint string) ([]byte, bool) {
+	fsys, err := VersionFS(version)
+	if err != nil {
+		return nil, false
+	}
+	data, err := fs.ReadFile(fsys, recording.PayloadPath(service, endpoint))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// readPayload unmarshals the recorded response of the given endpoint in fsys into result.
+func readPayload(fsys fs.FS, service, endpoint string, result interface{}) error {
+	data, err := fs.ReadFile(fsys, recording.PayloadPath(service, endpoint))
+	if err != nil {
+		return fmt.Errorf("no payload for %s %s: %w", service, endpoint, err)
+	}
+	return json.Unmarshal(data, result)
+}
+
+// services returns the service directories that fsys has payloads for.
+func services(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			result = append(result, entry.Name())
+		}
+	}
+	return result, nil
+}
+
+// Cluster is a fake single-node cluster, serving the payloads of one version, or of a scrape recorded by the
+// recording package.
+type Cluster struct {
+	// Version is the version reported by the recorded `/pools`.
+	Version string
+	// Node is the fake node, for passing to collectors.
+	Node *Node
+	// XDCRPort is the port of the fake XDCR REST API, or zero if there are no XDCR payloads.
+	XDCRPort int
+
+	rest      *restServers
+	memcached *MemcachedServer
+}
+
+// StartCluster starts a fake cluster for version, which must be one of Versions. Close must be called to stop it.
+func StartCluster(version string) (*Cluster, error) {
+	fsys, err := VersionFS(version)
+	if err != nil {
+		return nil, err
+	}
+	return StartClusterFS(fsys)
+}
+
+// StartClusterFS starts a fake cluster serving the payloads in fsys, which has the same layout as the directory of a
+// version in testdata, such as a scrape recorded by the recording package. Close must be called to stop it.
+func StartClusterFS(fsys fs.FS) (*Cluster, error) {
+	dirs, err := services(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payloads: %w", err)
+	}
+	c := &Cluster{}
+	ports := make(map[cbrest.Service]int)
+	for _, dir := range dirs {
+		if dir != recording.DirKV {
+			continue
+		}
+		c.memcached, err = startMemcachedServer(fsys)
+		if err != nil {
+			return nil, err
+		}
+		ports[cbrest.ServiceData] = c.memcached.Port()
+	}
+	c.rest = startRESTServers(fsys, dirs, ports)
+	if port, ok := c.rest.xdcrPort(); ok {
+		c.XDCRPort = port
+	}
+	c.Node, err = newNode(fsys, ports)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.Version = c.Node.version.String()
+	return c, nil
+}
+
+// Close stops the fake cluster.
+func (c *Cluster) Close() {
+	if c.Node != nil {
+		_ = c.Node.Close()
+	}
+	if c.rest != nil {
+		c.rest.close()
+	}
+	if c.memcached != nil {
+		_ = c.memcached.Close()
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fake
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+	memcached "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/stretchr/testify/require"
+)
+
+// newCluster starts a fake cluster for version, stopped when the test finishes. It can't be faketest.NewCluster, as
+// that imports this package.
+func newCluster(t *testing.T, version string) *Cluster {
+	t.Helper()
+	c, err := StartCluster(version)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestVersions(t *testing.T) {
+	require.Equal(t, []string{"6.0.5", "6.5.1", "6.6.0"}, Versions())
+}
+
+func TestRESTServers(t *testing.T) {
+	cluster := newCluster(t, "6.6.0")
+
+	version, err := cluster.Node.Version()
+	require.NoError(t, err)
+	require.Equal(t, "6.6.0", version.String())
+
+	has, err := cluster.Node.HasService(cbrest.ServiceGSI)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = cluster.Node.HasService(cbrest.ServiceAnalytics)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	res, err := cluster.Node.RestClient().Execute(&cbrest.Request{
+		Method:             http.MethodGet,
+		Endpoint:           "/api/v1/stats",
+		Service:            cbrest.ServiceGSI,
+		ExpectedStatusCode: http.StatusOK,
+	})
+	require.NoError(t, err)
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(res.Body, &stats))
+	require.Contains(t, stats, "indexer")
+
+	port, err := cluster.Node.GetServicePort(cbrest.ServiceGSI)
+	require.NoError(t, err)
+	url := "http://" + net.JoinHostPort(Hostname, strconv.Itoa(port)) + "/api/v1/stats"
+	httpRes, err := http.Get(url)
+	require.NoError(t, err)
+	httpRes.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, httpRes.StatusCode)
+}
+
+func TestMemcachedServer(t *testing.T) {
+	cluster := newCluster(t, "6.6.0")
+	port, err := cluster.Node.GetServicePort(cbrest.ServiceData)
+	require.NoError(t, err)
+
+	mc, err := memcached.Connect("tcp", net.JoinHostPort(Hostname, strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer mc.Close()
+
+	_, err = mc.StatsMap("")
+	require.Error(t, err, "should need authentication")
+	_, err = mc.Auth(Username, "wrong")
+	require.Error(t, err)
+	_, err = mc.Auth(Username, Password)
+	require.NoError(t, err)
+
+	res, err := mc.Send(&gomemcached.MCRequest{Opcode: opListBuckets})
+	require.NoError(t, err)
+	require.Equal(t, "beer-sample travel-sample", string(res.Body))
+
+	_, err = mc.SelectBucket("missing")
+	require.Error(t, err)
+	_, err = mc.SelectBucket("travel-sample")
+	require.NoError(t, err)
+
+	stats, err := mc.StatsMap("")
+	require.NoError(t, err)
+	require.Equal(t, "persistent", stats["ep_bucket_type"])
+	stats, err = mc.StatsMap("dcpagg :")
+	require.NoError(t, err)
+	require.Contains(t, stats, "replication:items_remaining")
+
+	res, err = mc.Send(&gomemcached.MCRequest{
+		Opcode: opGetCmdTimer,
+		Key:    []byte("travel-sample"),
+		Extras: []byte{byte(gomemcached.GET)},
+	})
+	require.NoError(t, err)
+	var timings struct {
+		Data  [][3]float64 `json:"data"`
+		Total float64      `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(res.Body, &timings))
+	require.NotEmpty(t, timings.Data)
+
+	res, err = mc.Send(&gomemcached.MCRequest{
+		Opcode: opGetCmdTimer,
+		Key:    []byte("travel-sample"),
+		Extras: []byte{byte(gomemcached.APPEND)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(res.Body, &timings))
+	require.Empty(t, timings.Data)
+}
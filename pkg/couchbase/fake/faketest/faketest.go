@@ -0,0 +1,72 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package faketest has the helpers for using the fake cluster in tests. They are separate from the fake package, as
+// that is also used by the exporter to replay recorded scrapes, and shouldn't link the testing package.
+package faketest
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake"
+)
+
+// NewCluster starts a fake cluster for version, which must be one of fake.Versions. It is stopped when the test
+// finishes.
+func NewCluster(t testing.TB, version string) *fake.Cluster {
+	t.Helper()
+	c, err := fake.StartCluster(version)
+	if err != nil {
+		t.Fatalf("Failed to start fake %s cluster: %v", version, err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// NewClusterFS starts a fake cluster serving the payloads in fsys, see fake.StartClusterFS. It is stopped when the test
+// finishes.
+func NewClusterFS(t testing.TB, fsys fs.FS) *fake.Cluster {
+	t.Helper()
+	c, err := fake.StartClusterFS(fsys)
+	if err != nil {
+		t.Fatalf("Failed to start fake cluster: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// Payloads returns a copy of the payloads of version, for tests to change before passing to NewClusterFS.
+func Payloads(t testing.TB, version string) fstest.MapFS {
+	t.Helper()
+	src, err := fake.VersionFS(version)
+	if err != nil {
+		t.Fatalf("Failed to get payloads: %v", err)
+	}
+	result := make(fstest.MapFS)
+	err = fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(src, path)
+		result[path] = &fstest.MapFile{Data: data}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to copy payloads: %v", err)
+	}
+	return result
+}
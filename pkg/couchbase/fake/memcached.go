@@ -0,0 +1,258 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+)
+
+// Opcodes that gomemcached doesn't have constants for.
+const (
+	opListBuckets  = gomemcached.CommandCode(0x87)
+	opGetCmdTimer  = gomemcached.CommandCode(0xf3)
+	authMechanisms = "PLAIN"
+)
+
+// MemcachedServer is a fake memcached server, which answers the binary protocol requests the KV collector makes:
+// SASL authentication, bucket listing and selection, STAT groups, and command timings. Anything else gets
+// UNKNOWN_COMMAND.
+type MemcachedServer struct {
+	listener net.Listener
+	buckets  map[string]*recording.Bucket
+
+	mux   sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// StartMemcachedServer starts a fake memcached server with the recorded buckets of version. Close must be called to
+// stop it.
+func StartMemcachedServer(version string) (*MemcachedServer, error) {
+	fsys, err := VersionFS(version)
+	if err != nil {
+		return nil, err
+	}
+	return startMemcachedServer(fsys)
+}
+
+func startMemcachedServer(fsys fs.FS) (*MemcachedServer, error) {
+	buckets, err := loadBuckets(fsys)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(Hostname, "0"))
+	if err != nil {
+		return nil, err
+	}
+	s := &MemcachedServer{
+		listener: listener,
+		buckets:  buckets,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// loadBuckets reads the buckets in the `kv` directory of fsys. Their timings are optional, as they aren't recorded
+// when the metric set has no command timings.
+func loadBuckets(fsys fs.FS) (map[string]*recording.Bucket, error) {
+	entries, err := fs.ReadDir(fsys, recording.DirKV)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[string]*recording.Bucket)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		bucket := &recording.Bucket{}
+		name := entry.Name()
+		if err := readPayload(fsys, recording.DirKV, name+"/stats", &bucket.Stats); err != nil {
+			return nil, fmt.Errorf("failed to read stats of bucket %s: %w", name, err)
+		}
+		err := readPayload(fsys, recording.DirKV, name+"/timings", &bucket.Timings)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read timings of bucket %s: %w", name, err)
+		}
+		buckets[name] = bucket
+	}
+	return buckets, nil
+}
+
+// Port returns the port that the server is listening on.
+func (s *MemcachedServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server, closing any open connections.
+func (s *MemcachedServer) Close() error {
+	err := s.listener.Close()
+	s.mux.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mux.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *MemcachedServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mux.Lock()
+		s.conns[conn] = true
+		s.mux.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mux.Lock()
+			delete(s.conns, conn)
+			s.mux.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// session is the state of a single connection.
+type session struct {
+	authenticated bool
+	bucket        string
+}
+
+func (s *MemcachedServer) handle(conn net.Conn) {
+	var sess session
+	hdr := make([]byte, gomemcached.HDR_LEN)
+	for {
+		// Read the header first, so that a closed connection isn't reported as an error by MCRequest.Receive.
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		var req gomemcached.MCRequest
+		if _, err := req.Receive(io.MultiReader(bytes.NewReader(hdr), conn), nil); err != nil {
+			return
+		}
+		for _, res := range s.respond(&sess, &req) {
+			res.Opcode = req.Opcode
+			res.Opaque = req.Opaque
+			if _, err := res.Transmit(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// respond returns the responses to req, of which there is more than one for STAT.
+func (s *MemcachedServer) respond(sess *session, req *gomemcached.MCRequest) []*gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.SASL_LIST_MECHS:
+		return single(gomemcached.SUCCESS, []byte(authMechanisms))
+	case gomemcached.SASL_AUTH:
+		if string(req.Key) != authMechanisms || string(req.Body) != "\x00"+Username+"\x00"+Password {
+			return single(gomemcached.AUTH_ERROR, []byte("Auth failure"))
+		}
+		sess.authenticated = true
+		return single(gomemcached.SUCCESS, nil)
+	}
+	if !sess.authenticated {
+		return single(gomemcached.EACCESS, nil)
+	}
+	switch req.Opcode {
+	case opListBuckets:
+		names := make([]string, 0, len(s.buckets))
+		for name := range s.buckets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return single(gomemcached.SUCCESS, []byte(strings.Join(names, " ")))
+	case gomemcached.SELECT_BUCKET:
+		if _, ok := s.buckets[string(req.Key)]; !ok {
+			return single(gomemcached.KEY_ENOENT, nil)
+		}
+		sess.bucket = string(req.Key)
+		return single(gomemcached.SUCCESS, nil)
+	case gomemcached.STAT:
+		return s.stats(sess, string(req.Key))
+	case opGetCmdTimer:
+		return s.timings(sess, string(req.Key), req.Extras)
+	default:
+		return single(gomemcached.UNKNOWN_COMMAND, nil)
+	}
+}
+
+// stats returns a response for each stat in group, followed by the terminating response with no key.
+func (s *MemcachedServer) stats(sess *session, group string) []*gomemcached.MCResponse {
+	bucket, ok := s.buckets[sess.bucket]
+	if !ok {
+		return single(gomemcached.EACCESS, nil)
+	}
+	stats, ok := bucket.Stats[group]
+	if !ok {
+		return single(gomemcached.KEY_ENOENT, nil)
+	}
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*gomemcached.MCResponse, 0, len(keys)+1)
+	for _, key := range keys {
+		result = append(result, &gomemcached.MCResponse{Key: []byte(key), Body: []byte(stats[key])})
+	}
+	return append(result, &gomemcached.MCResponse{})
+}
+
+// timings returns the command timings of the opcode in extras. An empty bucket name is the selected bucket. Opcodes
+// without recorded timings get an empty histogram, as they would if the command had never been run.
+func (s *MemcachedServer) timings(sess *session, bucketName string, extras []byte) []*gomemcached.MCResponse {
+	if bucketName == "" {
+		bucketName = sess.bucket
+	}
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		return single(gomemcached.KEY_ENOENT, nil)
+	}
+	if len(extras) != 1 {
+		return single(gomemcached.EINVAL, nil)
+	}
+	body, ok := bucket.Timings[gomemcached.CommandCode(extras[0]).String()]
+	if !ok {
+		body = json.RawMessage(`{"bucketsLow":0,"data":[],"total":0}`)
+	}
+	return single(gomemcached.SUCCESS, body)
+}
+
+func single(status gomemcached.Status, body []byte) []*gomemcached.MCResponse {
+	return []*gomemcached.MCResponse{{Status: status, Body: body}}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fake
+
+import (
+	"io/fs"
+	"net"
+	"strconv"
+
+	"github.com/couchbase/tools-common/aprov"
+	"github.com/couchbase/tools-common/cbrest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+)
+
+// Hostname is the hostname of the fake node.
+const Hostname = "127.0.0.1"
+
+// Node is a fake couchbase.NodeCommon for the servers of a fake Cluster.
+type Node struct {
+	rest    *cbrest.Client
+	ports   map[cbrest.Service]int
+	version couchbase.Version
+}
+
+var _ couchbase.NodeCommon = (*Node)(nil)
+
+func newNode(fsys fs.FS, ports map[cbrest.Service]int) (*Node, error) {
+	var pools struct {
+		ImplementationVersion string `json:"implementationVersion"`
+	}
+	if err := readPayload(fsys, recording.ServiceDirs[cbrest.ServiceManagement], "/pools", &pools); err != nil {
+		return nil, err
+	}
+	parsed, err := couchbase.ParseVersion(pools.ImplementationVersion)
+	if err != nil {
+		return nil, err
+	}
+	client, err := cbrest.NewClient(cbrest.ClientOptions{
+		ConnectionString: "http://" + net.JoinHostPort(Hostname, strconv.Itoa(ports[cbrest.ServiceManagement])),
+		Provider: &aprov.Static{
+			UserAgent: "cmos-exporter-test",
+			Username:  Username,
+			Password:  Password,
+		},
+		DisableCCP:     true,
+		ConnectionMode: cbrest.ConnectionModeThisNodeOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		rest:    client,
+		ports:   ports,
+		version: parsed,
+	}, nil
+}
+
+func (n *Node) Close() error {
+	n.rest.Close()
+	return nil
+}
+
+func (n *Node) RestClient() *cbrest.Client {
+	return n.rest
+}
+
+func (n *Node) Credentials() (string, string) {
+	return Username, Password
+}
+
+func (n *Node) GetServicePort(svc cbrest.Service) (int, error) {
+	return n.ports[svc], nil
+}
+
+func (n *Node) HasService(svc cbrest.Service) (bool, error) {
+	return n.ports[svc] > 0, nil
+}
+
+func (n *Node) Hostname() string {
+	return Hostname
+}
+
+func (n *Node) Version() (couchbase.Version, error) {
+	return n.version, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fake
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/tools-common/cbrest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// restServers is a REST server for each service, each on its own port, as their endpoints overlap.
+type restServers struct {
+	servers map[cbrest.Service]*httptest.Server
+}
+
+// startRESTServers starts a server for each of the REST services in dirs, and adds their ports to ports. The management
+// server's `/pools/default/nodeServices` is generated from ports when requested, so that clients use the fake servers.
+func startRESTServers(fsys fs.FS, dirs []string, ports map[cbrest.Service]int) *restServers {
+	present := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		present[dir] = true
+	}
+	r := &restServers{servers: make(map[cbrest.Service]*httptest.Server)}
+	for service, dir := range recording.ServiceDirs {
+		// KV's directory is for memcached.
+		if !present[dir] || service == cbrest.ServiceData {
+			continue
+		}
+		server := httptest.NewServer(payloadHandler(fsys, dir, ports))
+		r.servers[service] = server
+		if service != common.ServiceXDCR {
+			ports[service] = serverPort(server)
+		}
+	}
+	return r
+}
+
+func (r *restServers) xdcrPort() (int, bool) {
+	server, ok := r.servers[common.ServiceXDCR]
+	if !ok {
+		return 0, false
+	}
+	return serverPort(server), true
+}
+
+func (r *restServers) close() {
+	for _, server := range r.servers {
+		server.Close()
+	}
+}
+
+func serverPort(server *httptest.Server) int {
+	port, _ := strconv.Atoi(server.URL[strings.LastIndexByte(server.URL, ':')+1:])
+	return port
+}
+
+// payloadHandler serves the recorded payloads of the given service directory, keyed by request URI. Unknown URIs
+// get a 404, as they would from a version that doesn't have the endpoint.
+func payloadHandler(fsys fs.FS, dir string, ports map[cbrest.Service]int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != Username || pass != Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var data []byte
+		if dir == recording.ServiceDirs[cbrest.ServiceManagement] && r.URL.Path == string(cbrest.EndpointNodesServices) {
+			data, _ = json.Marshal(nodeServices(ports))
+		} else {
+			var err error
+			if data, err = fs.ReadFile(fsys, recording.PayloadPath(dir, r.URL.RequestURI())); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
+
+// nodeServices returns the `/pools/default/nodeServices` response for a single node with the given service ports.
+func nodeServices(ports map[cbrest.Service]int) map[string]interface{} {
+	services := make(map[string]int, len(ports))
+	for service, port := range ports {
+		services[string(service)] = port
+	}
+	return map[string]interface{}{
+		"rev": 1,
+		"nodesExt": []map[string]interface{}{
+			{
+				"services": services,
+				"thisNode": true,
+				"hostname": Hostname,
+			},
+		},
+	}
+}
@@ -24,4 +24,5 @@ type NodeCommon interface {
 	GetServicePort(svc cbrest.Service) (int, error)
 	HasService(svc cbrest.Service) (bool, error)
 	Hostname() string
+	Version() (Version, error)
 }
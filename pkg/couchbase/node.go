@@ -23,6 +23,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/couchbase/tools-common/aprov"
 	"github.com/couchbase/tools-common/cbrest"
@@ -33,11 +34,13 @@ import (
 )
 
 type Node struct {
-	hostname string
-	creds    aprov.Provider
-	rest     *cbrest.Client
-	ccm      *cbrest.ClusterConfigManager
-	logger   *zap.SugaredLogger
+	hostname   string
+	creds      aprov.Provider
+	rest       *cbrest.Client
+	ccm        *cbrest.ClusterConfigManager
+	logger     *zap.SugaredLogger
+	version    *Version
+	versionMux sync.Mutex
 }
 
 func (n *Node) Hostname() string {
@@ -126,3 +129,35 @@ func (n *Node) HasService(service cbrest.Service) (bool, error) {
 	}
 	return cc.BootstrapNode().GetPort(service, false, false) > 0, nil
 }
+
+// Version returns the Couchbase Server version of this node. It is fetched once and then cached, as it can only
+// change if the node is restarted (which would also restart the exporter if it is running alongside it).
+func (n *Node) Version() (Version, error) {
+	n.versionMux.Lock()
+	defer n.versionMux.Unlock()
+	if n.version != nil {
+		return *n.version, nil
+	}
+	res, err := n.rest.Execute(&cbrest.Request{
+		Method:             http.MethodGet,
+		Endpoint:           "/pools",
+		Service:            cbrest.ServiceManagement,
+		ExpectedStatusCode: http.StatusOK,
+		Idempotent:         true,
+	})
+	if err != nil {
+		return Version{}, err
+	}
+	var pools struct {
+		ImplementationVersion string `json:"implementationVersion"`
+	}
+	if err := json.Unmarshal(res.Body, &pools); err != nil {
+		return Version{}, err
+	}
+	version, err := ParseVersion(pools.ImplementationVersion)
+	if err != nil {
+		return Version{}, err
+	}
+	n.version = &version
+	return version, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package recording saves the raw responses that the collectors get from Couchbase Server during each scrape, so that
+// they can be replayed by the fake cluster in pkg/couchbase/fake to reproduce a problem without access to the cluster.
+//
+// A recording is a directory with a subdirectory per scrape. Each scrape holds the response of each REST endpoint as
+// `<service>/<endpoint>.json` (or `<service>/<endpoint>/<query>.json` if it has a query string), the memcached responses of each bucket as `kv/<bucket>/stats.json` and
+// `kv/<bucket>/timings.json`, and the exporter's output for the scrape as `metrics.txt`. This is the same layout as the
+// fake cluster's recorded payloads.
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// Service directories that aren't for a REST service.
+const (
+	DirKV = "kv"
+	// MetricsFile is the file in each scrape that holds the exporter's output.
+	MetricsFile = "metrics.txt"
+)
+
+// ServiceDirs maps services to the directory of their responses.
+var ServiceDirs = map[cbrest.Service]string{
+	cbrest.ServiceManagement: "management",
+	cbrest.ServiceData:       DirKV,
+	cbrest.ServiceGSI:        "index",
+	cbrest.ServiceQuery:      "query",
+	cbrest.ServiceSearch:     "search",
+	cbrest.ServiceEventing:   "eventing",
+	cbrest.ServiceAnalytics:  "analytics",
+	cbrest.ServiceBackup:     "backup",
+	common.ServiceXDCR:       "xdcr",
+}
+
+// PayloadPath returns the path of the response of endpoint within the directory of its service. If endpoint has a query
+// string, the response is in a directory named after the endpoint's path, in a file named after the (normalized) query,
+// so that requests for the same endpoint with different parameters are kept apart. The path is kept within dir.
+func PayloadPath(dir, endpoint string) string {
+	var query string
+	if idx := strings.IndexByte(endpoint, '?'); idx >= 0 {
+		endpoint, query = endpoint[:idx], endpoint[idx+1:]
+	}
+	endpoint = strings.TrimPrefix(path.Clean("/"+endpoint), "/")
+	if values, err := url.ParseQuery(query); err == nil && len(values) > 0 {
+		endpoint = path.Join(endpoint, values.Encode())
+	}
+	return path.Join(dir, endpoint+".json")
+}
+
+// Bucket is the recorded memcached responses of a single bucket.
+type Bucket struct {
+	// Stats is the stats of each STAT group, keyed by group name (the default group is "").
+	Stats map[string]map[string]string
+	// Timings is the GET_CMD_TIMER response for each opcode, keyed by opcode name.
+	Timings map[string]json.RawMessage
+}
+
+// Recorder is a common.Recorder that saves the responses of each scrape to its own directory. Scrapes are delimited
+// by the Gatherer it wraps, and responses outside of a scrape are dropped.
+type Recorder struct {
+	root   string
+	logger *zap.SugaredLogger
+	// maxScrapes is the number of scrape directories to keep, or 0 to keep them all.
+	maxScrapes int
+	// static are files that are added to every scrape, keyed by path.
+	static map[string][]byte
+
+	// scrapeMux is held for the duration of a scrape, so that concurrent scrapes don't mix their responses.
+	scrapeMux sync.Mutex
+	mux       sync.Mutex
+	// files is nil outside of a scrape.
+	files   map[string][]byte
+	buckets map[string]*Bucket
+}
+
+var _ common.Recorder = (*Recorder)(nil)
+
+// NewRecorder creates a Recorder that saves to scrape directories in root. It also records node's `/pools`, which
+// every scrape needs to replay, as the version comes from it. Once there are more than maxScrapes scrape directories in
+// root, the oldest are deleted after each scrape; if maxScrapes is 0, they are all kept.
+func NewRecorder(logger *zap.SugaredLogger, root string, node couchbase.NodeCommon, maxScrapes int) (*Recorder, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	res, err := node.RestClient().Execute(&cbrest.Request{
+		Method:             http.MethodGet,
+		Endpoint:           "/pools",
+		Service:            cbrest.ServiceManagement,
+		ExpectedStatusCode: http.StatusOK,
+		Idempotent:         true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get /pools: %w", err)
+	}
+	return &Recorder{
+		root:       root,
+		logger:     logger,
+		maxScrapes: maxScrapes,
+		static: map[string][]byte{
+			PayloadPath(ServiceDirs[cbrest.ServiceManagement], "/pools"): res.Body,
+		},
+	}, nil
+}
+
+// Gatherer wraps g so that each Gather is recorded as a scrape, along with its output.
+func (r *Recorder) Gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		r.begin()
+		mfs, err := g.Gather()
+		dir, saveErr := r.end(mfs)
+		if saveErr != nil {
+			r.logger.Errorw("Failed to save recording of scrape", "error", saveErr)
+		} else {
+			r.logger.Debugw("Recorded scrape", "dir", dir)
+			if err := r.prune(); err != nil {
+				r.logger.Warnw("Failed to delete old recorded scrapes", "error", err)
+			}
+		}
+		return mfs, err
+	})
+}
+
+func (r *Recorder) begin() {
+	r.scrapeMux.Lock()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.files = make(map[string][]byte)
+	r.buckets = make(map[string]*Bucket)
+}
+
+// end finishes the scrape, and saves it with the exporter's output mfs. It returns the scrape's directory.
+func (r *Recorder) end(mfs []*dto.MetricFamily) (string, error) {
+	defer r.scrapeMux.Unlock()
+	r.mux.Lock()
+	files, buckets := r.files, r.buckets
+	r.files, r.buckets = nil, nil
+	r.mux.Unlock()
+
+	for name, bucket := range buckets {
+		for file, value := range map[string]interface{}{"stats": bucket.Stats, "timings": bucket.Timings} {
+			data, err := json.MarshalIndent(value, "", "  ")
+			if err != nil {
+				return "", fmt.Errorf("failed to marshal %s of bucket %s: %w", file, name, err)
+			}
+			files[PayloadPath(DirKV, name+"/"+file)] = data
+		}
+	}
+	for file, data := range r.static {
+		files[file] = data
+	}
+	var output bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&output, mf); err != nil {
+			return "", fmt.Errorf("failed to encode output: %w", err)
+		}
+	}
+	files[MetricsFile] = output.Bytes()
+
+	// Write to a temporary directory first, so that a scrape directory is always complete.
+	name := time.Now().UTC().Format(scrapeNameFormat)
+	tmp, err := os.MkdirTemp(r.root, "."+name+"-")
+	if err != nil {
+		return "", err
+	}
+	for file, data := range files {
+		full := filepath.Join(tmp, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			_ = os.RemoveAll(tmp)
+			return "", err
+		}
+		if err := os.WriteFile(full, data, 0o644); err != nil {
+			_ = os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	dir := filepath.Join(r.root, name)
+	if err := os.Rename(tmp, dir); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+	return dir, nil
+}
+
+// scrapeNameFormat is the time format of the names of scrape directories, which sort in the order they were recorded.
+const scrapeNameFormat = "20060102T150405.000Z"
+
+// prune deletes the oldest scrape directories in root, so that at most maxScrapes are left. Anything else in root is
+// left alone.
+func (r *Recorder) prune() error {
+	if r.maxScrapes <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return err
+	}
+	var scrapes []string
+	for _, entry := range entries {
+		if _, err := time.Parse(scrapeNameFormat, entry.Name()); err == nil && entry.IsDir() {
+			scrapes = append(scrapes, entry.Name())
+		}
+	}
+	// ReadDir sorts by name, so the oldest come first.
+	for len(scrapes) > r.maxScrapes {
+		if err := os.RemoveAll(filepath.Join(r.root, scrapes[0])); err != nil {
+			return err
+		}
+		scrapes = scrapes[1:]
+	}
+	return nil
+}
+
+func (r *Recorder) RecordREST(service cbrest.Service, endpoint string, body []byte) {
+	dir, ok := ServiceDirs[service]
+	if !ok {
+		dir = string(service)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.files != nil {
+		r.files[PayloadPath(dir, endpoint)] = append([]byte(nil), body...)
+	}
+}
+
+func (r *Recorder) RecordStats(bucket, group string, stats map[string]string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if b := r.bucket(bucket); b != nil {
+		copied := make(map[string]string, len(stats))
+		for key, value := range stats {
+			copied[key] = value
+		}
+		b.Stats[group] = copied
+	}
+}
+
+func (r *Recorder) RecordTimings(bucket, opcode string, body []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if b := r.bucket(bucket); b != nil {
+		b.Timings[opcode] = append(json.RawMessage(nil), body...)
+	}
+}
+
+// bucket returns the recording of the named bucket in the current scrape, or nil outside of one. r.mux must be held.
+func (r *Recorder) bucket(name string) *Bucket {
+	if r.buckets == nil {
+		return nil
+	}
+	b, ok := r.buckets[name]
+	if !ok {
+		b = &Bucket{Stats: make(map[string]map[string]string), Timings: make(map[string]json.RawMessage)}
+		r.buckets[name] = b
+	}
+	return b
+}
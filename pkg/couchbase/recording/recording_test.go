@@ -0,0 +1,68 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package recording_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake/faketest"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+)
+
+// TestMaxScrapes checks that only the latest scrapes are kept, and that nothing else in the directory is deleted.
+func TestMaxScrapes(t *testing.T) {
+	cluster := faketest.NewCluster(t, "6.6.0")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "keep"), 0o755))
+	recorder, err := recording.NewRecorder(zap.NewNop().Sugar(), dir, cluster.Node, 2)
+	require.NoError(t, err)
+	gatherer := recorder.Gatherer(prometheus.NewRegistry())
+
+	// scrapes lists the scrape directories in dir, oldest first.
+	scrapes := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var result []string
+		for _, entry := range entries {
+			if _, err := os.Stat(filepath.Join(dir, entry.Name(), recording.MetricsFile)); err == nil {
+				result = append(result, entry.Name())
+			}
+		}
+		return result
+	}
+	var recorded []string
+	for i := 0; i < 4; i++ {
+		before := scrapes()
+		_, err := gatherer.Gather()
+		require.NoError(t, err)
+		after := scrapes()
+		require.NotEqual(t, before, after)
+		recorded = append(recorded, after[len(after)-1])
+		// Scrape directories are named by the millisecond.
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.Equal(t, recorded[2:], scrapes())
+	require.FileExists(t, filepath.Join(dir, "notes.txt"))
+	require.DirExists(t, filepath.Join(dir, "keep"))
+}
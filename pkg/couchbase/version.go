@@ -0,0 +1,65 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package couchbase
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a Couchbase Server version, ignoring the build number and edition.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersion parses a version such as `6.6.0`, or `6.6.0-7909-enterprise` as reported by `/pools`.
+// Missing minor or patch components are treated as zero.
+func ParseVersion(val string) (Version, error) {
+	if idx := strings.IndexByte(val, '-'); idx >= 0 {
+		val = val[:idx]
+	}
+	parts := strings.Split(val, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", val)
+	}
+	var nums [3]int
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %q: %w", val, err)
+		}
+		nums[i] = num
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// Less returns whether v is an earlier version than other.
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
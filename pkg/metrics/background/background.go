@@ -0,0 +1,206 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package background runs collectors on an interval in the background, and serves the latest metrics of each on
+// scrape, so that the load on Couchbase Server doesn't grow with the number of Prometheus servers scraping it.
+package background
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// Collector wraps a common.Collector to collect it every interval, and to serve the metrics of the latest collection
+// when collected. Until the first collection has succeeded, it serves only the status of the attempts. A collection that
+// fails or times out leaves the metrics of the previous one in place.
+type Collector struct {
+	common.Collector
+	logger   *zap.SugaredLogger
+	interval time.Duration
+
+	ageDesc       *prometheus.Desc
+	timestampDesc *prometheus.Desc
+	durationDesc  *prometheus.Desc
+	attemptDesc   *prometheus.Desc
+	successDesc   *prometheus.Desc
+
+	mux sync.RWMutex
+	// snapshot is the metrics of the latest collection, which started at collected and took duration.
+	snapshot  []prometheus.Metric
+	collected time.Time
+	duration  time.Duration
+	// attempted is the start of the latest collection, successful or not, and succeeded is whether it was.
+	attempted time.Time
+	succeeded bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewCollector starts collecting c every interval. Close must be called to stop it.
+func NewCollector(logger *zap.SugaredLogger, c common.Collector, interval time.Duration) *Collector {
+	constLabels := prometheus.Labels{"collector": c.Name()}
+	bc := &Collector{
+		Collector: c,
+		logger:    logger,
+		interval:  interval,
+		ageDesc: prometheus.NewDesc("cmos_exporter_collection_age_seconds",
+			"Seconds since the start of the collection that the collector's metrics are from, in background collection",
+			nil, constLabels),
+		timestampDesc: prometheus.NewDesc("cmos_exporter_collection_timestamp_seconds",
+			"Unix time of the start of the collection that the collector's metrics are from, in background collection",
+			nil, constLabels),
+		durationDesc: prometheus.NewDesc("cmos_exporter_collection_duration_seconds",
+			"Time taken by the collection that the collector's metrics are from, in background collection", nil,
+			constLabels),
+		attemptDesc: prometheus.NewDesc("cmos_exporter_collection_last_attempt_timestamp_seconds",
+			"Unix time of the start of the latest collection, whether or not it succeeded, in background collection",
+			nil, constLabels),
+		successDesc: prometheus.NewDesc("cmos_exporter_collection_last_attempt_success",
+			"Whether the latest collection succeeded (1) or failed or timed out (0), in background collection", nil,
+			constLabels),
+		done: make(chan struct{}),
+	}
+	var ctx context.Context
+	ctx, bc.cancel = context.WithCancel(context.Background())
+	go bc.run(ctx)
+	return bc
+}
+
+// Close stops collecting, abandoning any collection in progress. It doesn't close the wrapped collector.
+func (c *Collector) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *Collector) run(ctx context.Context) {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh collects the wrapped collector, and replaces the snapshot with the result if the collection succeeded.
+// Collections that take longer than the interval are abandoned where the collector allows, so that the snapshot doesn't
+// fall further behind, and count as failed.
+func (c *Collector) refresh(ctx context.Context) {
+	collectCtx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+	start := time.Now()
+	metrics := make(chan prometheus.Metric)
+	var err error
+	go func() {
+		// The wrapped collector logs and counts its own errors.
+		err = c.Collector.CollectContext(collectCtx, metrics)
+		close(metrics)
+	}()
+	var snapshot []prometheus.Metric
+	for metric := range metrics {
+		snapshot = append(snapshot, metric)
+	}
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		// Stopping.
+		return
+	}
+	if collectCtx.Err() != nil {
+		c.logger.Warnw("Background collection did not complete in time, keeping the previous metrics",
+			"collector", c.Name(), "interval", c.interval, "elapsed", duration)
+	} else if err != nil {
+		c.logger.Warnw("Background collection failed, keeping the previous metrics", "collector", c.Name(),
+			"error", err)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.attempted = start
+	c.succeeded = err == nil && collectCtx.Err() == nil
+	if !c.succeeded {
+		return
+	}
+	c.snapshot = snapshot
+	c.collected = start
+	c.duration = duration
+}
+
+// Describe describes the wrapped collector's metrics and the status metrics. If the wrapped collector describes none,
+// neither does this, so that it stays unchecked.
+func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
+	wrapped := make(chan *prometheus.Desc)
+	go func() {
+		c.Collector.Describe(wrapped)
+		close(wrapped)
+	}()
+	checked := false
+	for desc := range wrapped {
+		descs <- desc
+		checked = true
+	}
+	if checked {
+		descs <- c.ageDesc
+		descs <- c.timestampDesc
+		descs <- c.durationDesc
+		descs <- c.attemptDesc
+		descs <- c.successDesc
+	}
+}
+
+// Collect sends the metrics of the latest successful collection, and the status metrics.
+func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
+	c.mux.RLock()
+	snapshot, collected, duration := c.snapshot, c.collected, c.duration
+	attempted, succeeded := c.attempted, c.succeeded
+	c.mux.RUnlock()
+	if attempted.IsZero() {
+		return
+	}
+	emit := common.NewEmitter(c.Name(), metrics)
+	success := 0.0
+	if succeeded {
+		success = 1
+	}
+	emit.Metric(c.attemptDesc, prometheus.GaugeValue, float64(attempted.UnixNano())/1e9)
+	emit.Metric(c.successDesc, prometheus.GaugeValue, success)
+	if collected.IsZero() {
+		return
+	}
+	for _, metric := range snapshot {
+		metrics <- metric
+	}
+	emit.Metric(c.ageDesc, prometheus.GaugeValue, time.Since(collected).Seconds())
+	emit.Metric(c.timestampDesc, prometheus.GaugeValue, float64(collected.UnixNano())/1e9)
+	emit.Metric(c.durationDesc, prometheus.GaugeValue, duration.Seconds())
+}
+
+// CollectContext is the same as Collect, as it doesn't collect from Couchbase Server. It never returns an error, as the
+// errors of the background collections are reported when they happen.
+func (c *Collector) CollectContext(_ context.Context, metrics chan<- prometheus.Metric) error {
+	c.Collect(metrics)
+	return nil
+}
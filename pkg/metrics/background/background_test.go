@@ -0,0 +1,179 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package background
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// countingCollector emits the number of times it has been collected. If hang is set, collections emit and then wait
+// for the context to be done, and if fail is set, they return an error.
+type countingCollector struct {
+	common.Base
+	desc        *prometheus.Desc
+	unchecked   bool
+	collections atomic.Int64
+	hang        atomic.Bool
+	fail        atomic.Bool
+}
+
+func newCountingCollector(unchecked bool) *countingCollector {
+	return &countingCollector{
+		Base:      common.NewBase("counting", zap.NewNop().Sugar(), nil),
+		desc:      prometheus.NewDesc("test_collections", "Number of collections", nil, nil),
+		unchecked: unchecked,
+	}
+}
+
+func (c *countingCollector) Describe(descs chan<- *prometheus.Desc) {
+	if !c.unchecked {
+		descs <- c.desc
+	}
+}
+
+func (c *countingCollector) Collect(metrics chan<- prometheus.Metric) {
+	_ = c.CollectContext(context.Background(), metrics)
+}
+
+func (c *countingCollector) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(c.collections.Inc()))
+	if c.hang.Load() {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if c.fail.Load() {
+		return errors.New("collection failed")
+	}
+	return nil
+}
+
+func (c *countingCollector) Update(common.MetricSet) error {
+	return nil
+}
+
+func TestCollectorServesSnapshot(t *testing.T) {
+	wrapped := newCountingCollector(false)
+	bc := NewCollector(zap.NewNop().Sugar(), wrapped, time.Hour)
+	defer bc.Close()
+
+	// Nothing is served until the first collection is done.
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(bc) > 0
+	}, time.Second, time.Millisecond)
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(bc))
+	for i := 0; i < 3; i++ {
+		count, err := testutil.GatherAndCount(reg, "test_collections", "cmos_exporter_collection_age_seconds",
+			"cmos_exporter_collection_timestamp_seconds", "cmos_exporter_collection_duration_seconds")
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+	}
+	// Every scrape got the metrics of the first collection.
+	require.Equal(t, int64(1), wrapped.collections.Load())
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP test_collections Number of collections
+# TYPE test_collections counter
+test_collections 1
+`), "test_collections"))
+}
+
+func TestCollectorRefreshes(t *testing.T) {
+	wrapped := newCountingCollector(false)
+	bc := NewCollector(zap.NewNop().Sugar(), wrapped, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return wrapped.collections.Load() >= 3
+	}, time.Second, time.Millisecond)
+	require.NoError(t, bc.Close())
+	stopped := wrapped.collections.Load()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, stopped, wrapped.collections.Load())
+}
+
+// gatherGauges returns the value of each of the background collector's single-series metrics.
+func gatherGauges(t *testing.T, bc *Collector) map[string]float64 {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(bc))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.Metric[0]
+		values[family.GetName()] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+	}
+	return values
+}
+
+func TestCollectorKeepsSnapshotOnFailure(t *testing.T) {
+	for _, mode := range []string{"hang", "fail"} {
+		t.Run(mode, func(t *testing.T) {
+			wrapped := newCountingCollector(false)
+			bc := NewCollector(zap.NewNop().Sugar(), wrapped, 10*time.Millisecond)
+			defer bc.Close()
+			require.Eventually(t, func() bool {
+				return wrapped.collections.Load() >= 1
+			}, time.Second, time.Millisecond)
+			if mode == "hang" {
+				wrapped.hang.Store(true)
+			} else {
+				wrapped.fail.Store(true)
+			}
+
+			// Wait for a collection that started after the switch to have failed.
+			waitFor := func() {
+				after := wrapped.collections.Load() + 1
+				require.Eventually(t, func() bool {
+					return wrapped.collections.Load() > after
+				}, time.Second, time.Millisecond)
+			}
+			waitFor()
+			failed := gatherGauges(t, bc)
+			require.Equal(t, 0.0, failed["cmos_exporter_collection_last_attempt_success"])
+			require.Greater(t, failed["cmos_exporter_collection_last_attempt_timestamp_seconds"],
+				failed["cmos_exporter_collection_timestamp_seconds"])
+
+			// Later failures still serve the metrics of the last successful collection.
+			waitFor()
+			later := gatherGauges(t, bc)
+			require.Equal(t, 0.0, later["cmos_exporter_collection_last_attempt_success"])
+			require.Equal(t, failed["test_collections"], later["test_collections"])
+			require.Equal(t, failed["cmos_exporter_collection_timestamp_seconds"],
+				later["cmos_exporter_collection_timestamp_seconds"])
+			require.Less(t, later["test_collections"], float64(wrapped.collections.Load()))
+		})
+	}
+}
+
+func TestCollectorStaysUnchecked(t *testing.T) {
+	bc := NewCollector(zap.NewNop().Sugar(), newCountingCollector(true), time.Hour)
+	defer bc.Close()
+	descs := make(chan *prometheus.Desc, 10)
+	bc.Describe(descs)
+	close(descs)
+	require.Empty(t, descs)
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+)
+
+// MetricSet is the metric set of a single collector, such as gsi.MetricSet.
+type MetricSet interface {
+	Validate() error
+}
+
+// Collector is implemented by the collector for each service.
+type Collector interface {
+	prometheus.Collector
+	// Name is the name of the collector, such as `gsi`, used in logs and self-metrics.
+	Name() string
+	// Update replaces the collector's metric set. ms must be the collector's own MetricSet type.
+	Update(ms MetricSet) error
+	// CollectContext is the same as Collect, but gives up on any outstanding requests once ctx is done. It returns the
+	// errors that caused metrics to be skipped, as reported to the collection's Emitter, or nil if there were none.
+	CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error
+	// SetRecorder makes the collector pass the raw responses it gets to r. It must be called before collecting.
+	SetRecorder(r Recorder)
+	// SetBucketFilter makes the collector skip the buckets that f doesn't allow, without requesting their stats where
+	// possible. It must be called before collecting.
+	SetBucketFilter(f *Filter)
+}
+
+// ServiceXDCR stands for XDCR's REST API, which isn't a cbrest service, when passing its responses to a Recorder.
+const ServiceXDCR cbrest.Service = "xdcr"
+
+// Recorder saves the raw Couchbase responses that collectors get, so that they can be replayed without the cluster.
+// See the recording package.
+type Recorder interface {
+	// RecordREST saves the response body of a REST endpoint of service.
+	RecordREST(service cbrest.Service, endpoint string, body []byte)
+	// RecordStats saves the stats of a memcached STAT group of bucket. The default group is "".
+	RecordStats(bucket, group string, stats map[string]string)
+	// RecordTimings saves the GET_CMD_TIMER response body for an opcode of bucket.
+	RecordTimings(bucket, opcode string, body []byte)
+}
+
+// CollectionErrors counts the errors that collectors report to their Emitter, each of which means that some of their
+// metrics were skipped. It must be registered alongside the collectors.
+var CollectionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cmos_exporter_collection_errors_total",
+	Help: "Number of errors that caused metrics to be skipped, by collector",
+}, []string{"collector"})
+
+// Base implements the parts of a Collector that are the same for every service. Collectors embed it.
+type Base struct {
+	Logger *zap.SugaredLogger
+	Node   couchbase.NodeCommon
+	name   string
+	// recorder is nil unless recording.
+	recorder Recorder
+	// buckets is nil unless filtering buckets.
+	buckets *Filter
+}
+
+// NewBase returns a Base for the collector with the given name. node may be nil for collectors that don't need it.
+func NewBase(name string, logger *zap.SugaredLogger, node couchbase.NodeCommon) Base {
+	return Base{
+		Logger: logger,
+		Node:   node,
+		name:   name,
+	}
+}
+
+func (b Base) Name() string {
+	return b.name
+}
+
+func (b *Base) SetRecorder(r Recorder) {
+	b.recorder = r
+}
+
+func (b *Base) SetBucketFilter(f *Filter) {
+	b.buckets = f
+}
+
+// BucketAllowed returns whether to collect the metrics of bucket.
+func (b Base) BucketAllowed(bucket string) bool {
+	return b.buckets.Allowed(bucket)
+}
+
+// RecordREST passes a REST response body to the recorder, if any.
+func (b Base) RecordREST(service cbrest.Service, endpoint string, body []byte) {
+	if b.recorder != nil {
+		b.recorder.RecordREST(service, endpoint, body)
+	}
+}
+
+// RecordStats passes the stats of a memcached STAT group to the recorder, if any.
+func (b Base) RecordStats(bucket, group string, stats map[string]string) {
+	if b.recorder != nil {
+		b.recorder.RecordStats(bucket, group, stats)
+	}
+}
+
+// RecordTimings passes a memcached command timings response body to the recorder, if any.
+func (b Base) RecordTimings(bucket, opcode string, body []byte) {
+	if b.recorder != nil {
+		b.recorder.RecordTimings(bucket, opcode, body)
+	}
+}
+
+// StartCollection logs the start of a collection, and returns a function that logs its end, for use as
+// `defer c.StartCollection()()`.
+func (b Base) StartCollection() func() {
+	start := time.Now()
+	b.Logger.Infof("Starting %s collection", b.name)
+	return func() {
+		b.Logger.Infow(fmt.Sprintf("Completed %s collection", b.name), "elapsed", time.Since(start))
+	}
+}
+
+// Emitter returns an Emitter for this collector that sends to metrics.
+func (b Base) Emitter(metrics chan<- prometheus.Metric) Emitter {
+	return NewEmitter(b.name, metrics)
+}
+
+// Fetch gets the given endpoint of service, and unmarshals its JSON response into result.
+func (b Base) Fetch(ctx context.Context, service cbrest.Service, endpoint string, result interface{}) error {
+	res, err := b.Node.RestClient().ExecuteWithContext(ctx, &cbrest.Request{
+		Method:             http.MethodGet,
+		Endpoint:           cbrest.Endpoint(endpoint),
+		Service:            service,
+		ExpectedStatusCode: http.StatusOK,
+		Idempotent:         true,
+	})
+	if err != nil {
+		return err
+	}
+	b.RecordREST(service, endpoint, res.Body)
+	if err := json.Unmarshal(res.Body, result); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// WrongMetricSet is the error returned by Collector.Update when given another collector's MetricSet.
+func WrongMetricSet(collector string, ms MetricSet) error {
+	return fmt.Errorf("%s collector can't use a %T", collector, ms)
+}
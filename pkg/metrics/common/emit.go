@@ -0,0 +1,218 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InvalidMetrics counts the metrics that collectors failed to build, by collector. It must be registered alongside the
+// collectors.
+var InvalidMetrics = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cmos_exporter_invalid_metrics_total",
+	Help: "Number of metrics that could not be built (for example because of a label mismatch), by collector",
+}, []string{"collector"})
+
+// Emitter builds metrics for a collector without panicking. If a metric can't be built, it is replaced by a
+// prometheus.NewInvalidMetric, which reports the error to the registry instead of crashing the scrape, and is counted
+// in InvalidMetrics.
+//
+// Collectors also report the errors that cause them to skip metrics to the Emitter of the collection, with Error, and
+// return them from CollectContext with Err.
+type Emitter struct {
+	collector string
+	metrics   chan<- prometheus.Metric
+	limits    []*SeriesLimit
+	// errors is shared by the copies of the Emitter made by WithLimits.
+	errors *collectionErrors
+}
+
+type collectionErrors struct {
+	mux  sync.Mutex
+	errs []error
+}
+
+// NewEmitter returns an Emitter that sends metrics to the given Collect channel. collector is the name of the
+// collector, used as the label of InvalidMetrics and CollectionErrors.
+func NewEmitter(collector string, metrics chan<- prometheus.Metric) Emitter {
+	return Emitter{collector: collector, metrics: metrics, errors: &collectionErrors{}}
+}
+
+// Error reports an error that caused some of the collection's metrics to be skipped. It is counted in
+// CollectionErrors, and returned by Err. Collectors log the error themselves, with whatever context they have.
+func (e Emitter) Error(err error) {
+	CollectionErrors.WithLabelValues(e.collector).Inc()
+	e.errors.mux.Lock()
+	defer e.errors.mux.Unlock()
+	e.errors.errs = append(e.errors.errs, err)
+}
+
+// Err returns the errors reported with Error as a *CollectionError, or nil if there were none.
+func (e Emitter) Err() error {
+	e.errors.mux.Lock()
+	defer e.errors.mux.Unlock()
+	if len(e.errors.errs) == 0 {
+		return nil
+	}
+	return &CollectionError{Collector: e.collector, Errors: append([]error(nil), e.errors.errs...)}
+}
+
+// CollectionError is the error returned by Collector.CollectContext when some metrics were skipped.
+type CollectionError struct {
+	Collector string
+	Errors    []error
+}
+
+func (e *CollectionError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%s collection had %d errors: %s", e.Collector, len(e.Errors), strings.Join(messages, "; "))
+}
+
+// WithLimits returns a copy of e that drops the metrics that would take it over any of limits. Nil limits are ignored.
+func (e Emitter) WithLimits(limits ...*SeriesLimit) Emitter {
+	e.limits = append(append([]*SeriesLimit(nil), e.limits...), limits...)
+	return e
+}
+
+// LimitReached returns whether any of e's limits has been reached, so metrics are being dropped.
+func (e Emitter) LimitReached() bool {
+	for _, limit := range e.limits {
+		if limit.Reached() {
+			return true
+		}
+	}
+	return false
+}
+
+// take takes n series from each of e's limits, and returns whether there was room for them in all of them.
+func (e Emitter) take(n int) bool {
+	for _, limit := range e.limits {
+		if !limit.room(n) {
+			return false
+		}
+	}
+	for _, limit := range e.limits {
+		if limit != nil {
+			limit.count += n
+		}
+	}
+	return true
+}
+
+// ConstMetric builds a constant metric, or an invalid metric if that fails.
+func (e Emitter) ConstMetric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64,
+	labelValues ...string,
+) prometheus.Metric {
+	metric, err := prometheus.NewConstMetric(desc, valueType, value, labelValues...)
+	return e.check(desc, metric, err)
+}
+
+// Metric builds and sends a constant metric.
+func (e Emitter) Metric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) {
+	if !e.take(1) {
+		return
+	}
+	e.metrics <- e.ConstMetric(desc, valueType, value, labelValues...)
+}
+
+// TypedMetric builds and sends a constant metric of type typ. If typ isn't a single value type (it is a histogram or
+// summary), an invalid metric is sent instead.
+func (e Emitter) TypedMetric(desc *prometheus.Desc, typ MetricType, value float64, labelValues ...string) {
+	if !e.take(1) {
+		return
+	}
+	valueType, err := typ.ToPrometheus()
+	if err != nil {
+		e.metrics <- e.check(desc, nil, err)
+		return
+	}
+	e.metrics <- e.ConstMetric(desc, valueType, value, labelValues...)
+}
+
+// Histogram builds and sends a constant histogram.
+func (e Emitter) Histogram(desc *prometheus.Desc, count uint64, sum float64, buckets map[float64]uint64,
+	labelValues ...string,
+) {
+	// A series for each bucket, including the implicit +Inf one, and for the count and sum.
+	series := len(buckets) + 2
+	if _, ok := buckets[math.Inf(1)]; !ok {
+		series++
+	}
+	if !e.take(series) {
+		return
+	}
+	metric, err := prometheus.NewConstHistogram(desc, count, sum, buckets, labelValues...)
+	e.metrics <- e.check(desc, metric, err)
+}
+
+// Summary builds and sends a constant summary.
+func (e Emitter) Summary(desc *prometheus.Desc, count uint64, sum float64, quantiles map[float64]float64,
+	labelValues ...string,
+) {
+	if !e.take(len(quantiles) + 2) {
+		return
+	}
+	metric, err := prometheus.NewConstSummary(desc, count, sum, quantiles, labelValues...)
+	e.metrics <- e.check(desc, metric, err)
+}
+
+func (e Emitter) check(desc *prometheus.Desc, metric prometheus.Metric, err error) prometheus.Metric {
+	if err != nil {
+		InvalidMetrics.WithLabelValues(e.collector).Inc()
+		return prometheus.NewInvalidMetric(desc, err)
+	}
+	return metric
+}
+
+// SeriesLimit is a maximum number of series for Emitters to send, to stop a collection from producing more series than
+// Prometheus can handle. Once a metric has been dropped for taking it over the limit, it is reached, and all later
+// metrics are dropped too. It isn't safe for concurrent use.
+type SeriesLimit struct {
+	max     int
+	count   int
+	reached bool
+}
+
+// NewSeriesLimit returns a limit of max series, or nil (no limit) if max is 0.
+func NewSeriesLimit(max int) *SeriesLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &SeriesLimit{max: max}
+}
+
+// Reached returns whether the limit has been reached. A nil limit is never reached.
+func (l *SeriesLimit) Reached() bool {
+	return l != nil && l.reached
+}
+
+func (l *SeriesLimit) room(n int) bool {
+	if l == nil {
+		return true
+	}
+	if !l.reached && l.count+n > l.max {
+		l.reached = true
+	}
+	return !l.reached
+}
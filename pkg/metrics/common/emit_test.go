@@ -0,0 +1,99 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitter(t *testing.T) {
+	desc := prometheus.NewDesc("test", "", []string{"bucket"}, nil)
+	metrics := make(chan prometheus.Metric, 5)
+	emit := NewEmitter("test", metrics)
+	before := testutil.ToFloat64(InvalidMetrics.WithLabelValues("test"))
+
+	emit.Metric(desc, prometheus.GaugeValue, 1, "default")
+	emit.Metric(desc, prometheus.GaugeValue, 1)
+	emit.Histogram(desc, 1, 1, map[float64]uint64{1: 1}, "default", "extra")
+	emit.TypedMetric(desc, MetricCounter, 1, "default")
+	// A summary isn't a single value.
+	emit.TypedMetric(desc, MetricSummary, 1, "default")
+	close(metrics)
+
+	var valid, invalid int
+	for metric := range metrics {
+		var out dto.Metric
+		if err := metric.Write(&out); err != nil {
+			invalid++
+		} else {
+			valid++
+		}
+	}
+	require.Equal(t, 2, valid)
+	require.Equal(t, 3, invalid)
+	require.Equal(t, before+3, testutil.ToFloat64(InvalidMetrics.WithLabelValues("test")))
+}
+
+func TestEmitterLimits(t *testing.T) {
+	desc := prometheus.NewDesc("test_limited", "", []string{"bucket"}, nil)
+	metrics := make(chan prometheus.Metric, 10)
+	global := NewSeriesLimit(6)
+	require.Nil(t, NewSeriesLimit(0))
+
+	// A histogram with one bucket is 4 series: that bucket, +Inf, count and sum.
+	a := NewEmitter("test", metrics).WithLimits(NewSeriesLimit(5), global)
+	a.Histogram(desc, 1, 1, map[float64]uint64{1: 1}, "a")
+	a.Metric(desc, prometheus.GaugeValue, 1, "a")
+	require.False(t, a.LimitReached())
+	a.Histogram(desc, 1, 1, map[float64]uint64{1: 1}, "a")
+	require.True(t, a.LimitReached())
+	// Once reached, even metrics that would fit are dropped.
+	a.Metric(desc, prometheus.GaugeValue, 1, "a")
+	require.False(t, global.Reached())
+
+	b := NewEmitter("test", metrics).WithLimits(nil, global)
+	b.Metric(desc, prometheus.GaugeValue, 1, "b")
+	require.False(t, b.LimitReached())
+	b.Metric(desc, prometheus.GaugeValue, 1, "b")
+	require.True(t, b.LimitReached())
+	require.True(t, global.Reached())
+
+	close(metrics)
+	require.Len(t, metrics, 3)
+}
+
+func TestEmitterErrors(t *testing.T) {
+	metrics := make(chan prometheus.Metric)
+	emit := NewEmitter("test_errors", metrics)
+	before := testutil.ToFloat64(CollectionErrors.WithLabelValues("test_errors"))
+	require.NoError(t, emit.Err())
+
+	emit.Error(errors.New("first"))
+	// Copies share the errors of the collection.
+	emit.WithLimits(NewSeriesLimit(1)).Error(errors.New("second"))
+	err := emit.Err()
+	var collectionErr *CollectionError
+	require.ErrorAs(t, err, &collectionErr)
+	require.Len(t, collectionErr.Errors, 2)
+	require.EqualError(t, err, "test_errors collection had 2 errors: first; second")
+	require.Equal(t, before+2, testutil.ToFloat64(CollectionErrors.WithLabelValues("test_errors")))
+}
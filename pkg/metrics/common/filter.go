@@ -0,0 +1,77 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Filter decides which names (of metrics or buckets) to collect, by allow and deny lists of regular expressions. As in
+// Prometheus relabelling, the expressions must match the whole name.
+type Filter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewFilter returns a Filter that allows the names that match any of include (or all names, if it's empty), except
+// those that match any of exclude. It returns nil if both are empty.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	var f Filter
+	var err error
+	if f.include, err = compileAnchored(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileAnchored(exclude); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func compileAnchored(exprs []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		exp, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", expr, err)
+		}
+		result[i] = exp
+	}
+	return result, nil
+}
+
+// Allowed returns whether name passes the filter. A nil Filter allows everything.
+func (f *Filter) Allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !matchesAny(f.include, name) {
+		return false
+	}
+	return !matchesAny(f.exclude, name)
+}
+
+func matchesAny(exps []*regexp.Regexp, name string) bool {
+	for _, exp := range exps {
+		if exp.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, f)
+	require.True(t, f.Allowed("anything"))
+
+	f, err = NewFilter([]string{"kv_.*", "index_items_count"}, []string{"kv_cmd_duration_seconds", ".*_bytes"})
+	require.NoError(t, err)
+	require.True(t, f.Allowed("kv_ops"))
+	require.True(t, f.Allowed("index_items_count"))
+	require.False(t, f.Allowed("kv_cmd_duration_seconds"))
+	require.False(t, f.Allowed("kv_mem_used_bytes"))
+	// Expressions must match the whole name.
+	require.False(t, f.Allowed("index_items_count_total"))
+	require.False(t, f.Allowed("n1ql_requests"))
+
+	f, err = NewFilter(nil, []string{"travel-sample"})
+	require.NoError(t, err)
+	require.True(t, f.Allowed("default"))
+	require.False(t, f.Allowed("travel-sample"))
+
+	_, err = NewFilter([]string{"("}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import "strings"
+
+// FlattenStats flattens nested stats objects into result, with keys being the dot-separated path to each value.
+func FlattenStats(prefix string, stats map[string]interface{}, result map[string]interface{}) {
+	for key, value := range stats {
+		path := key
+		if prefix != "" {
+			path = strings.Join([]string{prefix, key}, ".")
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			FlattenStats(path, nested, result)
+			continue
+		}
+		result[path] = value
+	}
+}
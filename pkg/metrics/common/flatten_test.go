@@ -0,0 +1,45 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlattenStats(t *testing.T) {
+	stats := map[string]interface{}{
+		"MainStore": map[string]interface{}{
+			"memory_size":    float64(1024),
+			"resident_ratio": 0.5,
+		},
+		"BackStore": map[string]interface{}{
+			"lss": map[string]interface{}{
+				"fragmentation": float64(12),
+			},
+		},
+		"memory_used": float64(2048),
+	}
+	result := make(map[string]interface{})
+	FlattenStats("", stats, result)
+	require.Equal(t, map[string]interface{}{
+		"MainStore.memory_size":       float64(1024),
+		"MainStore.resident_ratio":    0.5,
+		"BackStore.lss.fragmentation": float64(12),
+		"memory_used":                 float64(2048),
+	}, result)
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/itchyny/gojq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// CompileExpression parses and compiles a JQ-like (https://github.com/itchyny/gojq) expression.
+func CompileExpression(expression string) (*gojq.Code, error) {
+	query, err := gojq.Parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %w", err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile expression: %w", err)
+	}
+	return code, nil
+}
+
+// EmitExpression runs expr over input and emits a metric for each result. Each result must be either:
+//   - an array, where the first element is the stat value and all others are the label values (in the same order as
+//     labels), or
+//   - an object, with the stat value under `value` and each label value under the label's name.
+//
+// Values may be numbers, booleans (1 or 0), or numeric strings, and label values may be strings, numbers, or booleans.
+// Results that don't match, including those with the wrong number of labels, are logged and skipped, and the number
+// of them is returned.
+func EmitExpression(logger *zap.SugaredLogger, emit Emitter, key string, expr *gojq.Code,
+	input interface{}, desc *prometheus.Desc, typ MetricType, labels []string,
+) int {
+	var failed int
+	results := expr.Run(input)
+	for {
+		row, ok := results.Next()
+		if !ok {
+			break
+		}
+		if err, ok := row.(error); ok {
+			logger.Warnw("Error when evaluating expression", "metric", key, "error", err)
+			failed++
+			continue
+		}
+		logger.Debugw("Expression result", "metric", key, "value", row)
+		value, labelValues, err := parseExpressionResult(row, labels)
+		if err != nil {
+			logger.Warnw("Invalid expression result", "metric", key, "value", fmt.Sprintf("%#v", row), "error", err)
+			failed++
+			continue
+		}
+		emit.TypedMetric(desc, typ, value, labelValues...)
+	}
+	return failed
+}
+
+// parseExpressionResult gets the value and label values from a single result of an expression, see EmitExpression.
+func parseExpressionResult(row interface{}, labels []string) (float64, []string, error) {
+	var (
+		rawValue  interface{}
+		rawLabels []interface{}
+	)
+	switch result := row.(type) {
+	case []interface{}:
+		if len(result) == 0 {
+			return 0, nil, fmt.Errorf("empty array")
+		}
+		rawValue, rawLabels = result[0], result[1:]
+	case map[string]interface{}:
+		var ok bool
+		if rawValue, ok = result["value"]; !ok {
+			return 0, nil, fmt.Errorf("object has no value")
+		}
+		rawLabels = make([]interface{}, len(labels))
+		for i, label := range labels {
+			if rawLabels[i], ok = result[label]; !ok {
+				return 0, nil, fmt.Errorf("object has no %s label", label)
+			}
+		}
+	default:
+		return 0, nil, fmt.Errorf("expected an array or object, got %T", row)
+	}
+	if len(rawLabels) != len(labels) {
+		return 0, nil, fmt.Errorf("expected %d labels, got %d", len(labels), len(rawLabels))
+	}
+	value, err := coerceValue(rawValue)
+	if err != nil {
+		return 0, nil, err
+	}
+	labelValues := make([]string, len(rawLabels))
+	for i, label := range rawLabels {
+		switch val := label.(type) {
+		case string:
+			labelValues[i] = val
+		case float64, int, bool:
+			labelValues[i] = fmt.Sprint(val)
+		default:
+			return 0, nil, fmt.Errorf("label %d is a %T, not a string", i, label)
+		}
+	}
+	return value, labelValues, nil
+}
+
+// coerceValue converts the value of an expression result to a float. gojq produces ints for integer literals and
+// some functions (such as length), so they are accepted as well as floats, booleans, and numeric strings.
+func coerceValue(raw interface{}) (float64, error) {
+	switch val := raw.(type) {
+	case string:
+		value, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value %q is not a number", val)
+		}
+		return value, nil
+	case *big.Int:
+		value, _ := new(big.Float).SetInt(val).Float64()
+		return value, nil
+	default:
+		if value, ok := ValueOf(raw, nil); ok {
+			return value, nil
+		}
+		return 0, fmt.Errorf("value is a %T, not a number", raw)
+	}
+}
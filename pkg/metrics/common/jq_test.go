@@ -0,0 +1,66 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEmitExpression(t *testing.T) {
+	labels := []string{"functionName", "status"}
+	input := map[string]interface{}{
+		"apps": []interface{}{
+			map[string]interface{}{"name": "fn1", "status": "deployed", "nodes": float64(2), "deployed": true},
+			map[string]interface{}{"name": "fn2", "status": "paused", "nodes": "1", "deployed": false},
+			map[string]interface{}{"name": "fn3", "status": nil, "nodes": float64(1), "deployed": true},
+		},
+	}
+	cases := []struct {
+		Name       string
+		Expression string
+		Emitted    int
+		Failed     int
+	}{
+		{Name: "array", Expression: ".apps[] | [.nodes, .name, .status]", Emitted: 2, Failed: 1},
+		{Name: "integer literal", Expression: ".apps[] | [1, .name, .name]", Emitted: 3},
+		{Name: "bool", Expression: ".apps[] | [.deployed, .name, .name]", Emitted: 3},
+		{Name: "too few labels", Expression: ".apps[] | [.nodes, .name]", Failed: 3},
+		{Name: "too many labels", Expression: ".apps[] | [.nodes, .name, .name, .name]", Failed: 3},
+		{
+			Name:       "object",
+			Expression: ".apps[] | {value: .nodes, functionName: .name, status: .name}",
+			Emitted:    3,
+		},
+		{Name: "object missing label", Expression: ".apps[] | {value: .nodes, functionName: .name}", Failed: 3},
+		{Name: "not an array", Expression: ".apps[] | .nodes", Failed: 3},
+		{Name: "error", Expression: ".apps[] | error(\"bad\")", Failed: 3},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, err := CompileExpression(tc.Expression)
+			require.NoError(t, err)
+			metrics := make(chan prometheus.Metric, 10)
+			failed := EmitExpression(zap.NewNop().Sugar(), NewEmitter("test", metrics), "test", code, input,
+				prometheus.NewDesc("test", "", labels, nil), MetricGauge, labels)
+			require.Equal(t, tc.Failed, failed)
+			require.Len(t, metrics, tc.Emitted)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+// DefaultCollection is the name of the default scope and collection, which is where all the data is before 7.0.
+const DefaultCollection = "_default"
+
+// IndexLabelNames returns the names of the labels of per-index metrics (as used by GSI and FTS). scope and
+// collection are only included if fakeCollections is set, as 7.x always has them.
+func IndexLabelNames(fakeCollections bool) []string {
+	if fakeCollections {
+		return []string{"bucket", "scope", "collection", "index"}
+	}
+	return []string{"bucket", "index"}
+}
+
+// IndexLabelValues returns the label values for IndexLabelNames. A blank scope or collection is the default one.
+func IndexLabelValues(fakeCollections bool, bucket, scope, collection, index string) []string {
+	if !fakeCollections {
+		return []string{bucket, index}
+	}
+	if scope == "" {
+		scope = DefaultCollection
+	}
+	if collection == "" {
+		collection = DefaultCollection
+	}
+	return []string{bucket, scope, collection, index}
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexLabelValues(t *testing.T) {
+	require.Equal(t, []string{"bucket", "index"}, IndexLabelNames(false))
+	require.Equal(t, []string{"b", "i"}, IndexLabelValues(false, "b", "s", "c", "i"))
+
+	require.Equal(t, []string{"bucket", "scope", "collection", "index"}, IndexLabelNames(true))
+	require.Equal(t, []string{"b", "s", "c", "i"}, IndexLabelValues(true, "b", "s", "c", "i"))
+	require.Equal(t, []string{"b", "_default", "_default", "i"}, IndexLabelValues(true, "b", "", "", "i"))
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// Metadata is the help text, unit, and type of a metric, as exposed by Couchbase Server 7.x.
+type Metadata struct {
+	Help string     `json:"help"`
+	Unit string     `json:"unit,omitempty"`
+	Type MetricType `json:"type"`
+}
+
+// metadata.json is derived from the stats definitions in 7.x (kv_engine's stats.def.h and the per-service
+// definitions in ns_server). It is keyed by the Prometheus metric name.
+//
+//go:embed metadata.json
+var metadataJSON []byte
+
+var metadataCatalogue map[string]Metadata
+
+func init() {
+	if err := json.Unmarshal(metadataJSON, &metadataCatalogue); err != nil {
+		panic(fmt.Errorf("failed to load metrics metadata: %w", err))
+	}
+}
+
+// LookupMetadata returns the bundled metadata for the given Prometheus metric name, if there is any.
+func LookupMetadata(name string) (Metadata, bool) {
+	md, ok := metadataCatalogue[name]
+	return md, ok
+}
+
+// ResolveHelp returns help if it is set, otherwise the help text from the bundled metadata for name.
+func ResolveHelp(name, help string) string {
+	if help != "" {
+		return help
+	}
+	if md, ok := metadataCatalogue[name]; ok {
+		return md.Help
+	}
+	return ""
+}
+
+// ResolveType returns typ if it is set, otherwise the type from the bundled metadata for name.
+// If neither is known, the result is blank, which is treated as untyped.
+func ResolveType(name string, typ MetricType) MetricType {
+	if typ != "" {
+		return typ
+	}
+	if md, ok := metadataCatalogue[name]; ok {
+		return md.Type
+	}
+	return ""
+}
@@ -15,7 +15,11 @@
 
 package common
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type MetricType string
 
@@ -23,17 +27,40 @@ const (
 	MetricGauge     MetricType = "gauge"
 	MetricCounter   MetricType = "counter"
 	MetricHistogram MetricType = "histogram"
+	MetricUntyped   MetricType = "untyped"
+	MetricSummary   MetricType = "summary"
 )
 
-func (m MetricType) ToPrometheus() prometheus.ValueType {
+// Validate checks that m is a known metric type. A blank type is valid, and means the type will be taken from the
+// bundled metadata. Histograms and summaries are only valid if they are listed in extra, as only some collectors can
+// produce them.
+func (m MetricType) Validate(extra ...MetricType) error {
+	switch m {
+	case "", MetricGauge, MetricCounter, MetricUntyped:
+		return nil
+	case MetricHistogram, MetricSummary:
+		for _, allowed := range extra {
+			if m == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("metric type %s is not supported by this collector", m)
+	default:
+		return fmt.Errorf("unknown metric type %q", m)
+	}
+}
+
+// ToPrometheus returns the ValueType of a metric of type m. Histograms and summaries don't have one, as they aren't a
+// single value.
+func (m MetricType) ToPrometheus() (prometheus.ValueType, error) {
 	switch m {
 	case MetricGauge:
-		return prometheus.GaugeValue
+		return prometheus.GaugeValue, nil
 	case MetricCounter:
-		return prometheus.CounterValue
-	case MetricHistogram:
-		panic("Histogram can't be converted into a ValueType")
+		return prometheus.CounterValue, nil
+	case MetricHistogram, MetricSummary:
+		return 0, fmt.Errorf("%s can't be converted into a ValueType", m)
 	default:
-		return prometheus.UntypedValue
+		return prometheus.UntypedValue, nil
 	}
 }
@@ -0,0 +1,176 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// ValidationError is a problem with a metric set, at the JSON path of the value at fault, such as
+// `.gsi.index_items_count.type`.
+type ValidationError struct {
+	Path string
+	Err  error
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is every problem found with a metric set. The Validate method of each collector's metric set
+// returns one, with paths relative to that metric set, so that they can be nested in the full metric set.
+type ValidationErrors []ValidationError
+
+// Add records err, found at path.
+func (v *ValidationErrors) Add(path string, err error) {
+	*v = append(*v, ValidationError{Path: path, Err: err})
+}
+
+// Addf records a problem found at path.
+func (v *ValidationErrors) Addf(path, format string, args ...interface{}) {
+	v.Add(path, fmt.Errorf(format, args...))
+}
+
+// Nest records err, found at path. If err is a ValidationErrors, each of its problems is recorded under path.
+func (v *ValidationErrors) Nest(path string, err error) {
+	var nested ValidationErrors
+	if !errors.As(err, &nested) {
+		v.Add(path, err)
+		return
+	}
+	for _, problem := range nested {
+		v.Add(path+problem.Path, problem.Err)
+	}
+}
+
+// Err returns v sorted by path, or nil if there are no problems.
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Path < v[j].Path
+	})
+	return v
+}
+
+func (v ValidationErrors) Error() string {
+	problems := make([]string, len(v))
+	for i, problem := range v {
+		problems[i] = problem.Error()
+	}
+	return strings.Join(problems, "\n")
+}
+
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// JSONPath returns path extended by each of elems, which are object keys (as `.key`, or `["key"]` if it isn't an
+// identifier) or array indexes (as `[0]`).
+func JSONPath(path string, elems ...interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(path)
+	for _, elem := range elems {
+		switch elem := elem.(type) {
+		case int:
+			sb.WriteString("[" + strconv.Itoa(elem) + "]")
+		case string:
+			if identifierRe.MatchString(elem) {
+				sb.WriteString("." + elem)
+			} else {
+				sb.WriteString("[" + strconv.Quote(elem) + "]")
+			}
+		default:
+			panic(fmt.Sprintf("invalid JSON path element %v", elem))
+		}
+	}
+	return sb.String()
+}
+
+// CheckMetricName returns an error if name isn't a valid Prometheus metric name.
+func CheckMetricName(name string) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	return nil
+}
+
+// CheckLabelNames returns an error if any of labels or the names of constLabels aren't valid Prometheus label names,
+// or if any of them are repeated.
+func CheckLabelNames(labels []string, constLabels prometheus.Labels) error {
+	seen := make(map[string]bool, len(labels)+len(constLabels))
+	check := func(label string) error {
+		if !model.LabelName(label).IsValid() || strings.HasPrefix(label, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", label)
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate label %q", label)
+		}
+		seen[label] = true
+		return nil
+	}
+	for _, label := range labels {
+		if err := check(label); err != nil {
+			return err
+		}
+	}
+	for label := range constLabels {
+		if err := check(label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Definition is a metric defined by a metric set, for checking that collectors don't define the same metric with
+// different labels.
+type Definition struct {
+	// Path is the JSON path of the metric's definition, relative to the collector's metric set.
+	Path string
+	Name string
+	// Labels are the names of the metric's labels, including constant labels, or nil if they are chosen by the
+	// collector's options rather than the metric set.
+	Labels []string
+}
+
+// Definer is implemented by metric sets that can list the metrics they define.
+type Definer interface {
+	Definitions() []Definition
+}
+
+// DefinitionLabels returns the label names of a metric with the given labels and constant labels, for a Definition.
+func DefinitionLabels(labels []string, constLabels prometheus.Labels) []string {
+	result := append(make([]string, 0, len(labels)+len(constLabels)), labels...)
+	for label := range constLabels {
+		result = append(result, label)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONPath(t *testing.T) {
+	require.Equal(t, ".stats.kv_ops[1].labels", JSONPath("", "stats", "kv_ops", 1, "labels"))
+	require.Equal(t, `.memcached["dcpagg :"]`, JSONPath(".memcached", "dcpagg :"))
+}
+
+func TestValidationErrors(t *testing.T) {
+	var inner ValidationErrors
+	require.NoError(t, inner.Err())
+	inner.Addf(".b.type", "bad type")
+	inner.Addf(".a", "bad name")
+
+	var outer ValidationErrors
+	outer.Nest(".gsi", inner.Err())
+	outer.Nest(".fts", errors.New("plain"))
+	err := outer.Err()
+	require.Error(t, err)
+	require.Equal(t, ".fts: plain\n.gsi.a: bad name\n.gsi.b.type: bad type", err.Error())
+}
+
+func TestCheckLabelNames(t *testing.T) {
+	require.NoError(t, CheckLabelNames([]string{"bucket", "op"}, prometheus.Labels{"category": "system"}))
+	require.ErrorContains(t, CheckLabelNames([]string{"bucket", "bucket"}, nil), "duplicate")
+	require.ErrorContains(t, CheckLabelNames([]string{"bucket"}, prometheus.Labels{"bucket": "x"}), "duplicate")
+	require.ErrorContains(t, CheckLabelNames([]string{"op-name"}, nil), "invalid label name")
+	require.ErrorContains(t, CheckLabelNames([]string{"__name__"}, nil), "invalid label name")
+	require.ErrorContains(t, CheckMetricName("kv-ops"), "invalid metric name")
+	require.NoError(t, CheckMetricName("kv_ops"))
+}
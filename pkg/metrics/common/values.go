@@ -0,0 +1,40 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+// ValueOf converts a stat value from a JSON response to a float. Numbers are used as they are, booleans are 1 if true
+// and 0 if false, and strings are looked up in values (which may be nil), for stats that report a state. The result
+// is false for anything else, including strings that aren't in values, in which case the stat should be skipped.
+func ValueOf(raw interface{}, values map[string]float64) (float64, bool) {
+	switch val := raw.(type) {
+	case float64:
+		return val, true
+	case int64:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case bool:
+		if val {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		value, ok := values[val]
+		return value, ok
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueOf(t *testing.T) {
+	states := map[string]float64{"ready": 1, "building": 2}
+	cases := []struct {
+		Name     string
+		Raw      interface{}
+		Values   map[string]float64
+		Expected float64
+		OK       bool
+	}{
+		{Name: "float", Raw: 1.5, Expected: 1.5, OK: true},
+		{Name: "int64", Raw: int64(3), Expected: 3, OK: true},
+		{Name: "true", Raw: true, Expected: 1, OK: true},
+		{Name: "false", Raw: false, Expected: 0, OK: true},
+		{Name: "mapped string", Raw: "building", Values: states, Expected: 2, OK: true},
+		{Name: "unmapped string", Raw: "paused", Values: states},
+		{Name: "string without values", Raw: "ready"},
+		{Name: "nil", Raw: nil},
+		{Name: "object", Raw: map[string]interface{}{"a": 1.0}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			value, ok := ValueOf(tc.Raw, tc.Values)
+			require.Equal(t, tc.OK, ok)
+			require.Equal(t, tc.Expected, value)
+		})
+	}
+}
@@ -16,11 +16,10 @@
 package eventing
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
+	"net/url"
 	"sync"
-	"time"
 
 	"github.com/couchbase/tools-common/cbrest"
 	"github.com/itchyny/gojq"
@@ -28,41 +27,125 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 type Metric struct {
 	// Eventing metrics function a little differently to others, since they're an object, rather than just a flat list of
 	// stats. The expression is a JQ-like (https://github.com/itchyny/gojq) expression that must evaluate to an array,
 	// where the first element is a number (the stat value) and all others are strings, which will become labels (in the
-	// same order as the labels array).
-	Expression  string            `json:"expression"`
+	// same order as the labels array). It may instead evaluate to an object, with the value under `value` and each
+	// label under its name. See common.EmitExpression for the details.
+	//
+	// If Sources is set, the input to the expression is an object with the response of each source under its name,
+	// e.g. `.status.apps[]` for the status of each function. Otherwise, the input is just the stats of the functions,
+	// e.g. `.[]` for the stats of each function.
+	Expression string `json:"expression"`
+	// Sources are the endpoints (keys of Sources) the expression uses. If unset, the expression only uses `stats`.
+	Sources     []string          `json:"sources"`
 	Help        string            `json:"help"`
+	Type        common.MetricType `json:"type"`
 	Labels      []string          `json:"labels"`
 	ConstLabels prometheus.Labels `json:"constLabels"`
 }
 
+// Sources are the endpoints that metrics can use, by the name they appear under in the expression input:
+//   - `stats` is the execution, failure, and other stats of each function (an array);
+//   - `status` is the deployment and processing status of each function (`.apps` is an array);
+//   - `dcp_backlog` is the number of DCP events remaining for each deployed function (an object keyed by function
+//     name, of objects with the count under `dcp_backlog`). The endpoint takes a single function, so it is queried
+//     once for each function that `status` says is deployed.
+//
+// Each endpoint is only queried if at least one metric uses it.
+var Sources = map[string]cbrest.Endpoint{
+	SourceStats:      "/api/v1/stats",
+	SourceStatus:     "/api/v1/status",
+	SourceDCPBacklog: "/getDcpEventsRemaining",
+}
+
+const (
+	SourceStats      = "stats"
+	SourceStatus     = "status"
+	SourceDCPBacklog = "dcp_backlog"
+)
+
 type MetricSet map[string]Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(path, err)
+		}
+		if err := metric.Type.Validate(); err != nil {
+			errs.Add(path+".type", err)
+		}
+		if err := common.CheckLabelNames(metric.Labels, metric.ConstLabels); err != nil {
+			errs.Add(path+".labels", err)
+		}
+		if _, err := common.CompileExpression(metric.Expression); err != nil {
+			errs.Add(path+".expression", err)
+		}
+		for i, source := range metric.Sources {
+			if _, ok := Sources[source]; !ok {
+				errs.Addf(common.JSONPath(path, "sources", i), "unknown source %q", source)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key, metric := range ms {
+		defs = append(defs, common.Definition{
+			Path:   common.JSONPath("", key),
+			Name:   key,
+			Labels: common.DefinitionLabels(metric.Labels, metric.ConstLabels),
+		})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if allowed(key) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
 type metricInternal struct {
 	Metric
-	desc *prometheus.Desc
-	expr *gojq.Code
+	desc    *prometheus.Desc
+	expr    *gojq.Code
+	typ     common.MetricType
+	sources []string
+	// keyed is whether the expression input is keyed by source, see Metric.Expression.
+	keyed bool
 }
 
 type metricSetInternal map[string]metricInternal
 
 type Metrics struct {
-	logger *zap.SugaredLogger
-	node   couchbase.NodeCommon
+	common.Base
 	msi    metricSetInternal
 	msiMux sync.RWMutex
+	errors *prometheus.CounterVec
 }
 
 func NewCollector(logger *zap.SugaredLogger, node couchbase.NodeCommon, metrics MetricSet) (*Metrics, error) {
 	collector := &Metrics{
-		logger: logger,
-		node:   node,
-		msi:    make(metricSetInternal),
+		Base: common.NewBase("eventing", logger, node),
+		msi:  make(metricSetInternal),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmos_exporter_eventing_expression_errors_total",
+			Help: "Number of Eventing expression results that were invalid and skipped, by metric",
+		}, []string{"metric"}),
 	}
 	return collector, collector.updateMSI(metrics)
 }
@@ -73,70 +156,97 @@ func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
 	for _, metric := range m.msi {
 		descs <- metric.desc
 	}
+	m.errors.Describe(descs)
+}
+
+// Update replaces the metric set, which must be an eventing.MetricSet.
+func (m *Metrics) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(m.Name(), ms)
+	}
+	return m.updateMSI(metrics)
 }
 
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	m.logger.Info("Starting Eventing collection")
-	defer func() {
-		m.logger.Infow("Completed Eventing collection", "elapsed", time.Since(start))
-	}()
+	_ = m.CollectContext(context.Background(), metrics)
+}
+
+func (m *Metrics) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer m.StartCollection()()
 	m.msiMux.RLock()
 	defer m.msiMux.RUnlock()
-	res, err := m.node.RestClient().Execute(&cbrest.Request{
-		Method:             http.MethodGet,
-		Service:            cbrest.ServiceEventing,
-		Endpoint:           "/api/v1/stats",
-		ExpectedStatusCode: http.StatusOK,
-		Idempotent:         true,
-	})
-	if err != nil {
-		m.logger.Errorw("Failed to collect metrics", "error", err)
-		return
+	defer m.errors.Collect(metrics)
+	needed := make(map[string]bool)
+	for _, metric := range m.msi {
+		for _, source := range metric.sources {
+			needed[source] = true
+		}
 	}
-
-	// Metrics are an array of stats for each function
-	var metricValues []interface{}
-	if err := json.Unmarshal(res.Body, &metricValues); err != nil {
-		m.logger.Errorw("Failed to unmarshal metrics", "error", err)
-		return
+	emit := m.Emitter(metrics)
+	input := make(map[string]interface{}, len(needed))
+	if needed[SourceDCPBacklog] {
+		// The functions to get the backlog of come from the status.
+		needed[SourceStatus] = true
+	}
+	for source := range needed {
+		if source == SourceDCPBacklog {
+			continue
+		}
+		var value interface{}
+		err := m.Fetch(ctx, cbrest.ServiceEventing, string(Sources[source]), &value)
+		if err != nil {
+			m.Logger.Errorw("Failed to collect metrics", "source", source, "error", err)
+			emit.Error(err)
+			continue
+		}
+		input[source] = value
+	}
+	if status, ok := input[SourceStatus]; ok && needed[SourceDCPBacklog] {
+		input[SourceDCPBacklog] = m.fetchDCPBacklog(ctx, emit, status)
 	}
 
+metrics:
 	for key, metric := range m.msi {
-		results := metric.expr.Run(metricValues)
-		for {
-			row, ok := results.Next()
-			if !ok {
-				break
-			}
-			if err, ok := row.(error); ok {
-				m.logger.Warnw("Error when evaluating expression", "metric", key, "error", err)
-				continue
-			}
-			m.logger.Debugw("Expression result", "metric", key, "value", row)
-			result, ok := row.([]interface{})
-			if !ok {
-				m.logger.Warnw("Expression did not evaluate to an array", "metric", key, "value", fmt.Sprintf("%#v", result))
-				continue
-			}
-			value, ok := result[0].(float64)
-			if !ok {
-				m.logger.Warnw("Expression's first result was not a float64", "metric", key, "value", fmt.Sprintf("%#v", result[0]))
-				continue
-			}
-			labels := make([]string, 0, len(result)-1)
-			for i, label := range result[1:] {
-				labelValue, ok := label.(string)
-				if !ok {
-					m.logger.Warnw("Expression's label result was not a string", "metric", key, "i", i, "value", fmt.Sprintf("%#v", label))
-					continue
-				}
-				labels = append(labels, labelValue)
+		for _, source := range metric.sources {
+			if _, ok := input[source]; !ok {
+				continue metrics
 			}
+		}
+		var exprInput interface{} = input
+		if !metric.keyed {
+			exprInput = input[SourceStats]
+		}
+		if failed := common.EmitExpression(m.Logger, emit, key, metric.expr, exprInput, metric.desc, metric.typ,
+			metric.Labels); failed > 0 {
+			m.errors.WithLabelValues(key).Add(float64(failed))
+		}
+	}
+	return emit.Err()
+}
 
-			metrics <- prometheus.MustNewConstMetric(metric.desc, prometheus.UntypedValue, value, labels...)
+// fetchDCPBacklog gets the DCP backlog of each deployed function in status (the response of the `status` source),
+// keyed by function name. Functions whose backlog can't be fetched are left out.
+func (m *Metrics) fetchDCPBacklog(ctx context.Context, emit common.Emitter, status interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	statusObj, _ := status.(map[string]interface{})
+	apps, _ := statusObj["apps"].([]interface{})
+	for _, app := range apps {
+		appObj, _ := app.(map[string]interface{})
+		name, _ := appObj["name"].(string)
+		if deployed, _ := appObj["deployment_status"].(bool); name == "" || !deployed {
+			continue
+		}
+		var value interface{}
+		endpoint := string(Sources[SourceDCPBacklog]) + "?" + url.Values{"name": {name}}.Encode()
+		if err := m.Fetch(ctx, cbrest.ServiceEventing, endpoint, &value); err != nil {
+			m.Logger.Errorw("Failed to collect metrics", "source", SourceDCPBacklog, "function", name, "error", err)
+			emit.Error(err)
+			continue
 		}
+		result[name] = value
 	}
+	return result
 }
 
 func (m *Metrics) updateMSI(metrics MetricSet) error {
@@ -148,18 +258,20 @@ func (m *Metrics) updateMSI(metrics MetricSet) error {
 		if !ok {
 			existing = metricInternal{
 				Metric: metric,
-				desc:   prometheus.NewDesc(key, metric.Help, metric.Labels, metric.ConstLabels),
+				desc:   prometheus.NewDesc(key, common.ResolveHelp(key, metric.Help), metric.Labels, metric.ConstLabels),
 			}
 		}
-		query, err := gojq.Parse(metric.Expression)
+		existing.typ = common.ResolveType(key, metric.Type)
+		code, err := common.CompileExpression(metric.Expression)
 		if err != nil {
-			return fmt.Errorf("invalid expression for metric %s: %w", key, err)
-		}
-		code, err := gojq.Compile(query)
-		if err != nil {
-			return fmt.Errorf("failed to compile query for metric %s: %w", key, err)
+			return fmt.Errorf("eventing metric %s: %w", key, err)
 		}
 		existing.expr = code
+		existing.sources = metric.Sources
+		existing.keyed = len(metric.Sources) > 0
+		if !existing.keyed {
+			existing.sources = []string{SourceStats}
+		}
 		m.msi[key] = existing
 		alive[key] = true
 	}
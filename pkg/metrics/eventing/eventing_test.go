@@ -0,0 +1,140 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package eventing
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake/faketest"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+const testInput = `{
+	"stats": [{"function_name": "fn1", "execution_stats": {"on_update_success": 10}}],
+	"status": {"apps": [
+		{"name": "fn1", "composite_status": "deployed", "deployment_status": true, "num_deployed_nodes": 2},
+		{"name": "fn2", "composite_status": "paused", "deployment_status": true, "num_deployed_nodes": 1}
+	]},
+	"dcp_backlog": {"fn1": {"dcp_backlog": 5}, "fn2": {"dcp_backlog": 0}}
+}`
+
+func TestExpressionSources(t *testing.T) {
+	var input map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(testInput), &input))
+
+	cases := []struct {
+		Name       string
+		Expression string
+		Labels     []string
+		Expected   map[string]float64
+	}{
+		{
+			Name:       "stats",
+			Expression: ".stats[] | [.execution_stats.on_update_success, .function_name]",
+			Labels:     []string{"functionName"},
+			Expected:   map[string]float64{"fn1": 10},
+		},
+		{
+			Name:       "status",
+			Expression: ".status.apps[] | [.num_deployed_nodes, .name]",
+			Labels:     []string{"functionName"},
+			Expected:   map[string]float64{"fn1": 2, "fn2": 1},
+		},
+		{
+			Name:       "dcp backlog",
+			Expression: ".dcp_backlog | to_entries[] | [.value.dcp_backlog, .key]",
+			Labels:     []string{"functionName"},
+			Expected:   map[string]float64{"fn1": 5, "fn2": 0},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, err := common.CompileExpression(tc.Expression)
+			require.NoError(t, err)
+			desc := prometheus.NewDesc("test", "", tc.Labels, nil)
+			metrics := make(chan prometheus.Metric, 10)
+			failed := common.EmitExpression(zap.NewNop().Sugar(), common.NewEmitter("eventing", metrics), "test", code, input, desc,
+				common.MetricGauge, tc.Labels)
+			require.Zero(t, failed)
+			close(metrics)
+			actual := make(map[string]float64)
+			for metric := range metrics {
+				var out dto.Metric
+				require.NoError(t, metric.Write(&out))
+				actual[out.GetLabel()[0].GetValue()] = out.GetGauge().GetValue()
+			}
+			require.Equal(t, tc.Expected, actual)
+		})
+	}
+}
+
+// TestExpressionInput checks that expressions of metrics without sources get just the stats, so that metric sets
+// written before sources existed keep working, and those with sources get every source under its name.
+func TestExpressionInput(t *testing.T) {
+	cluster := faketest.NewCluster(t, "6.6.0")
+	m, err := NewCollector(zap.NewNop().Sugar(), cluster.Node, MetricSet{
+		"eventing_on_update_success": {
+			Labels:     []string{"functionName"},
+			Expression: ".[] | [.execution_stats.on_update_success, .function_name]",
+			Type:       common.MetricCounter,
+		},
+		"eventing_function_deployed_nodes": {
+			Labels:     []string{"functionName"},
+			Sources:    []string{SourceStats, SourceStatus},
+			Expression: ".stats[].function_name as $name | .status.apps[] | select(.name == $name) | [.num_deployed_nodes, .name]",
+			Type:       common.MetricGauge,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP eventing_function_deployed_nodes Number of Eventing nodes the function is deployed on
+# TYPE eventing_function_deployed_nodes gauge
+eventing_function_deployed_nodes{functionName="audit_changes"} 1
+eventing_function_deployed_nodes{functionName="expire_docs"} 1
+# HELP eventing_on_update_success Number of successful OnUpdate invocations
+# TYPE eventing_on_update_success counter
+eventing_on_update_success{functionName="audit_changes"} 7686
+eventing_on_update_success{functionName="expire_docs"} 26698
+`), "eventing_function_deployed_nodes", "eventing_on_update_success"))
+}
+
+// TestDCPBacklog checks that the DCP backlog is fetched for each deployed function, keyed by function name.
+func TestDCPBacklog(t *testing.T) {
+	cluster := faketest.NewCluster(t, "6.6.0")
+	m, err := NewCollector(zap.NewNop().Sugar(), cluster.Node, MetricSet{
+		"eventing_dcp_events_remaining": {
+			Labels:     []string{"functionName"},
+			Sources:    []string{SourceDCPBacklog},
+			Expression: ".dcp_backlog | to_entries[] | [.value.dcp_backlog, .key]",
+			Type:       common.MetricGauge,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP eventing_dcp_events_remaining Number of DCP mutations the function has yet to process, from /getDcpEventsRemaining
+# TYPE eventing_dcp_events_remaining gauge
+eventing_dcp_events_remaining{functionName="audit_changes"} 0
+eventing_dcp_events_remaining{functionName="expire_docs"} 117
+`), "eventing_dcp_events_remaining"))
+}
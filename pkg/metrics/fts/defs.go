@@ -0,0 +1,148 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fts
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// indexDef is an FTS index definition, as returned by `/api/index`. We only need the fields used for labels.
+type indexDef struct {
+	Name       string `json:"name"`
+	SourceType string `json:"sourceType"`
+	SourceName string `json:"sourceName"`
+	PlanParams struct {
+		IndexPartitions        int `json:"indexPartitions"`
+		MaxPartitionsPerPIndex int `json:"maxPartitionsPerPIndex"`
+	} `json:"planParams"`
+	Params struct {
+		DocConfig struct {
+			Mode string `json:"mode"`
+		} `json:"doc_config"`
+		Mapping struct {
+			Types map[string]struct {
+				Enabled bool `json:"enabled"`
+			} `json:"types"`
+		} `json:"mapping"`
+	} `json:"params"`
+}
+
+type indexDefsResponse struct {
+	IndexDefs struct {
+		IndexDefs map[string]indexDef `json:"indexDefs"`
+	} `json:"indexDefs"`
+}
+
+// numVBuckets is the number of source partitions of a Couchbase bucket, used to work out how many partitions an index
+// has if its definition predates `indexPartitions`.
+const numVBuckets = 1024
+
+// partitions returns the number of partitions (pindexes) of the index.
+func (d indexDef) partitions() int {
+	if d.PlanParams.IndexPartitions > 0 {
+		return d.PlanParams.IndexPartitions
+	}
+	if d.PlanParams.MaxPartitionsPerPIndex > 0 {
+		return (numVBuckets + d.PlanParams.MaxPartitionsPerPIndex - 1) / d.PlanParams.MaxPartitionsPerPIndex
+	}
+	return 1
+}
+
+// collection is a scope and collection that an index is defined on.
+type collection struct {
+	scope, name string
+}
+
+// collections returns the scopes and collections that the index is defined on, in order. Indexes only map collections
+// if their doc_config mode is one of the `scope.collection.*` modes, in which case each enabled type mapping is named
+// `scope.collection[.type]`. Otherwise, the index is on the default scope and collection.
+func (d indexDef) collections() []collection {
+	defaultCollection := []collection{{scope: common.DefaultCollection, name: common.DefaultCollection}}
+	if !strings.HasPrefix(d.Params.DocConfig.Mode, "scope.collection") {
+		return defaultCollection
+	}
+	seen := make(map[collection]bool)
+	var result []collection
+	for name, typ := range d.Params.Mapping.Types {
+		if !typ.Enabled {
+			continue
+		}
+		parts := strings.SplitN(name, ".", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		coll := collection{scope: parts[0], name: parts[1]}
+		if !seen[coll] {
+			seen[coll] = true
+			result = append(result, coll)
+		}
+	}
+	if len(result) == 0 {
+		return defaultCollection
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].scope != result[j].scope {
+			return result[i].scope < result[j].scope
+		}
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+// getIndexDefs gets the index definitions, keyed by index name.
+func (c *Collector) getIndexDefs(ctx context.Context) (map[string]indexDef, error) {
+	var result indexDefsResponse
+	if err := c.Fetch(ctx, cbrest.ServiceSearch, "/api/index", &result); err != nil {
+		return nil, err
+	}
+	return result.IndexDefs.IndexDefs, nil
+}
+
+// indexLabelNames and pindexLabelNames are the names of the labels of per-index and per-pindex metrics. Like 7.x,
+// index stats are only keyed by bucket and index, so that each index has one series per stat whatever its mapping is.
+var (
+	indexLabelNames  = []string{"bucket", "index"}
+	pindexLabelNames = []string{"bucket", "index", "pindex"}
+)
+
+// infoLabelNames are the names of the labels of fts_index_info, which carries the details of the index definition
+// that would otherwise make the stats' series change (or be repeated) whenever the index is changed.
+var infoLabelNames = []string{"bucket", "index", "scope", "collection", "source_type", "partitions"}
+
+var infoDesc = prometheus.NewDesc("fts_index_info",
+	"Information about an FTS index, with one series for each scope and collection that it indexes, always 1",
+	infoLabelNames, nil)
+
+// collectIndexInfo emits fts_index_info for each index in defs whose bucket is allowed.
+func (c *Collector) collectIndexInfo(emit common.Emitter, defs map[string]indexDef) {
+	for name, def := range defs {
+		if !c.BucketAllowed(def.SourceName) {
+			continue
+		}
+		partitions := strconv.Itoa(def.partitions())
+		for _, coll := range def.collections() {
+			emit.Metric(infoDesc, prometheus.GaugeValue, 1, def.SourceName, name, coll.scope, coll.name, def.SourceType, partitions)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fts
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+func TestIndexDefCollections(t *testing.T) {
+	cases := []struct {
+		Name                string
+		Def                 string
+		ExpectedCollections []collection
+		ExpectedPartitions  int
+	}{
+		{
+			Name:                "6.6 index",
+			Def:                 `{"params": {"doc_config": {"mode": "type_field"}}, "planParams": {"maxPartitionsPerPIndex": 171}}`,
+			ExpectedCollections: []collection{{scope: "_default", name: "_default"}},
+			ExpectedPartitions:  6,
+		},
+		{
+			Name: "single collection",
+			Def: `{"params": {"doc_config": {"mode": "scope.collection.type_field"}, "mapping": {"types": {
+				"inventory.airline": {"enabled": true}}}}, "planParams": {"indexPartitions": 1}}`,
+			ExpectedCollections: []collection{{scope: "inventory", name: "airline"}},
+			ExpectedPartitions:  1,
+		},
+		{
+			Name: "multiple collections",
+			Def: `{"params": {"doc_config": {"mode": "scope.collection.type_field"}, "mapping": {"types": {
+				"inventory.route.type": {"enabled": true}, "inventory.airline": {"enabled": true},
+				"inventory.route.other": {"enabled": true}, "tenant.users": {"enabled": true},
+				"inventory.hotel": {"enabled": false}}}}}`,
+			ExpectedCollections: []collection{
+				{scope: "inventory", name: "airline"},
+				{scope: "inventory", name: "route"},
+				{scope: "tenant", name: "users"},
+			},
+			ExpectedPartitions: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var def indexDef
+			require.NoError(t, json.Unmarshal([]byte(tc.Def), &def))
+			require.Equal(t, tc.ExpectedCollections, def.collections())
+			require.Equal(t, tc.ExpectedPartitions, def.partitions())
+		})
+	}
+}
+
+func TestCollectIndexInfo(t *testing.T) {
+	var def indexDef
+	require.NoError(t, json.Unmarshal([]byte(`{"sourceType": "gocbcore", "sourceName": "travel-sample",
+		"planParams": {"indexPartitions": 2}, "params": {"doc_config": {"mode": "scope.collection.type_field"},
+		"mapping": {"types": {"inventory.route": {"enabled": true}, "inventory.airline": {"enabled": true}}}}}`), &def))
+	c := &Collector{Base: common.NewBase("fts", zap.NewNop().Sugar(), nil)}
+
+	metrics := make(chan prometheus.Metric, 10)
+	c.collectIndexInfo(c.Emitter(metrics), map[string]indexDef{"travel": def})
+	close(metrics)
+
+	var labels [][]string
+	for metric := range metrics {
+		var out dto.Metric
+		require.NoError(t, metric.Write(&out))
+		require.Equal(t, 1.0, out.GetGauge().GetValue())
+		values := make([]string, 0, len(out.Label))
+		for _, label := range out.Label {
+			values = append(values, label.GetName()+"="+label.GetValue())
+		}
+		labels = append(labels, values)
+	}
+	// one series per collection, so the stats themselves only need the bucket and index
+	require.Equal(t, [][]string{
+		{"bucket=travel-sample", "collection=airline", "index=travel", "partitions=2", "scope=inventory",
+			"source_type=gocbcore"},
+		{"bucket=travel-sample", "collection=route", "index=travel", "partitions=2", "scope=inventory",
+			"source_type=gocbcore"},
+	}, labels)
+}
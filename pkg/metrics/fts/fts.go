@@ -16,92 +16,172 @@
 package fts
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"regexp"
 	"sync"
-	"time"
 
 	"github.com/couchbase/tools-common/cbrest"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 type Metric struct {
-	Name   string `json:"name"`
-	Global bool   `json:"global"`
+	// Name is the stat to use. Nested stats are named by their dot-separated path, e.g. `stat.field`.
+	Name   string            `json:"name"`
+	Global bool              `json:"global"`
+	Type   common.MetricType `json:"type"`
+	// Values maps the values of string stats (such as states) to numbers. String values that aren't in it are skipped.
+	Values map[string]float64 `json:"values"`
+	// Source is where FTS exposes this stat:
+	//   - `nsstats` (the default) is the `/api/nsstats` endpoint;
+	//   - `pindex` is the per-pindex stats in `/api/stats`, where Name is a dot-separated path into the stats of each
+	//     pindex (for example `basic.DocCount`), and the series have an extra `pindex` label. These can't be global,
+	//     and are only collected if pindexStats is passed to NewCollector.
+	Source string `json:"source"`
 }
 
+const (
+	SourceNSStats = "nsstats"
+	SourcePIndex  = "pindex"
+)
+
 type MetricSet map[string]Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(path, err)
+		}
+		if err := metric.Type.Validate(); err != nil {
+			errs.Add(path+".type", err)
+		}
+		switch metric.Source {
+		case "", SourceNSStats:
+		case SourcePIndex:
+			if metric.Global {
+				errs.Addf(path+".global", "pindex metrics can't be global")
+			}
+		default:
+			errs.Addf(path+".source", "unknown source %q", metric.Source)
+		}
+	}
+	return errs.Err()
+}
+
+// Definitions lists the metrics in ms. Their labels depend on the collector's options.
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key := range ms {
+		defs = append(defs, common.Definition{Path: common.JSONPath("", key), Name: key})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if allowed(key) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
 type metricInternal struct {
 	Metric
 	desc    *prometheus.Desc
 	ftsName string
+	typ     common.MetricType
 }
 
 // NOTE: metricSetInternal is keyed by FTS name, *not* Prometheus name.
 type metricSetInternal map[string]*metricInternal
 
 type Collector struct {
-	logger          *zap.SugaredLogger
-	node            couchbase.NodeCommon
-	msi             metricSetInternal
-	msiMux          sync.RWMutex
-	fakeCollections bool
+	common.Base
+	msi         metricSetInternal
+	pindexMSI   metricSetInternal
+	msiMux      sync.RWMutex
+	pindexStats bool
 }
 
-func NewCollector(logger *zap.SugaredLogger, node couchbase.NodeCommon, metrics MetricSet, fakeCollections bool) *Collector {
+// NewCollector creates the FTS collector. The per-pindex metrics are only collected if pindexStats is set, as they can
+// have a high cardinality.
+func NewCollector(logger *zap.SugaredLogger, node couchbase.NodeCommon, metrics MetricSet, pindexStats bool) *Collector {
 	c := &Collector{
-		logger:          logger,
-		node:            node,
-		fakeCollections: fakeCollections,
-		msi:             make(metricSetInternal),
+		Base:        common.NewBase("fts", logger, node),
+		pindexStats: pindexStats,
+		msi:         make(metricSetInternal),
+		pindexMSI:   make(metricSetInternal),
 	}
-	c.updateMSI(metrics)
+	c.update(metrics)
 	return c
 }
 
+// Update replaces the metric set, which must be an fts.MetricSet.
+func (c *Collector) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(c.Name(), ms)
+	}
+	c.update(metrics)
+	return nil
+}
+
 func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
 	c.msiMux.RLock()
 	defer c.msiMux.RUnlock()
+	descs <- infoDesc
 	for _, metric := range c.msi {
 		descs <- metric.desc
 	}
+	for _, metric := range c.pindexMSI {
+		descs <- metric.desc
+	}
 }
 
 var singleIndexStatRe = regexp.MustCompile(`^(?P<bucket>.+?):(?P<index>.+?):(?P<stat>.+)$`)
 
 func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	c.logger.Info("Starting FTS collection")
-	defer func() {
-		c.logger.Infow("Completed FTS collection", "elapsed", time.Since(start))
-	}()
+	_ = c.CollectContext(context.Background(), metrics)
+}
+
+func (c *Collector) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer c.StartCollection()()
 	c.msiMux.RLock()
 	defer c.msiMux.RUnlock()
 
-	response, err := c.node.RestClient().Execute(&cbrest.Request{
-		Method:             http.MethodGet,
-		Endpoint:           "/api/nsstats",
-		Service:            cbrest.ServiceSearch,
-		ExpectedStatusCode: http.StatusOK,
-		Idempotent:         true,
-	})
-	if err != nil {
-		c.logger.Errorw("Failed to get FTS stats", "error", err)
-		return
+	emit := c.Emitter(metrics)
+	if defs, err := c.getIndexDefs(ctx); err != nil {
+		c.Logger.Errorw("Failed to get FTS index definitions", "error", err)
+		emit.Error(err)
+	} else {
+		c.collectIndexInfo(emit, defs)
+	}
+	c.collectNSStats(ctx, emit)
+	if c.pindexStats && len(c.pindexMSI) > 0 {
+		c.collectPIndexes(ctx, emit)
 	}
+	return emit.Err()
+}
 
-	// most stats are float64s, but some are strings
-	var stats map[string]interface{}
-	if err := json.Unmarshal(response.Body, &stats); err != nil {
-		c.logger.Errorw("Failed to unmarshal FTS stats", "error", err)
+func (c *Collector) collectNSStats(ctx context.Context, emit common.Emitter) {
+	// most stats are float64s, but some are strings or nested objects
+	var raw map[string]interface{}
+	if err := c.Fetch(ctx, cbrest.ServiceSearch, "/api/nsstats", &raw); err != nil {
+		c.Logger.Errorw("Failed to get FTS stats", "error", err)
+		emit.Error(err)
 		return
 	}
+	stats := make(map[string]interface{}, len(raw))
+	common.FlattenStats("", raw, stats)
 
 	for key, rawValue := range stats {
 		var (
@@ -109,14 +189,13 @@ func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
 			ok     bool
 		)
 		statMatch := singleIndexStatRe.FindStringSubmatch(key)
-		labels := make(prometheus.Labels)
+		var bucket, index string
 		if statMatch != nil {
 			metric, ok = c.msi[statMatch[singleIndexStatRe.SubexpIndex("stat")]]
-			labels["bucket"] = statMatch[singleIndexStatRe.SubexpIndex("bucket")]
-			labels["index"] = statMatch[singleIndexStatRe.SubexpIndex("index")]
-			if c.fakeCollections {
-				labels["scope"] = "_default"
-				labels["collection"] = "_default"
+			bucket = statMatch[singleIndexStatRe.SubexpIndex("bucket")]
+			index = statMatch[singleIndexStatRe.SubexpIndex("index")]
+			if !c.BucketAllowed(bucket) {
+				continue
 			}
 		} else {
 			metric, ok = c.msi[key]
@@ -124,48 +203,49 @@ func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
 		if !ok {
 			continue
 		}
-		var value float64
-		switch valueTyp := rawValue.(type) {
-		case float64:
-			value = valueTyp
-		case int64:
-			value = float64(valueTyp)
-		default:
-			c.logger.Errorw("Got unexpected value type", "key", key, "value", valueTyp, "valueType", fmt.Sprintf("%T", valueTyp))
+		value, ok := common.ValueOf(rawValue, metric.Values)
+		if !ok {
+			c.Logger.Debugw("Skipping stat with unexpected value", "key", key, "value", rawValue,
+				"valueType", fmt.Sprintf("%T", rawValue))
+			continue
 		}
-		var labelValues []string
-		if !metric.Global {
-			if c.fakeCollections {
-				labelValues = []string{labels["bucket"], labels["scope"], labels["collection"], labels["index"]}
-			} else {
-				labelValues = []string{labels["bucket"], labels["index"]}
-			}
+		if metric.Global {
+			emit.TypedMetric(metric.desc, metric.typ, value)
+			continue
 		}
-		metrics <- prometheus.MustNewConstMetric(metric.desc, prometheus.UntypedValue, value, labelValues...)
+		emit.TypedMetric(metric.desc, metric.typ, value, bucket, index)
 	}
 }
 
-func (c *Collector) updateMSI(ms MetricSet) {
+func (c *Collector) update(ms MetricSet) {
 	c.msiMux.Lock()
 	defer c.msiMux.Unlock()
 	alive := make(map[string]bool)
+	pindexMSI := make(metricSetInternal)
 	for key, metric := range ms {
+		if metric.Source == SourcePIndex {
+			pindexMSI[key] = &metricInternal{
+				desc:    prometheus.NewDesc(key, common.ResolveHelp(key, ""), pindexLabelNames, nil),
+				Metric:  metric,
+				ftsName: metric.Name,
+				typ:     common.ResolveType(key, metric.Type),
+			}
+			continue
+		}
 		existing, ok := c.msi[metric.Name]
 		if !ok {
 			var labels []string
 			if !metric.Global {
-				if c.fakeCollections {
-					labels = []string{"bucket", "scope", "collection", "index"}
-				} else {
-					labels = []string{"bucket", "index"}
-				}
+				labels = indexLabelNames
 			}
 			existing = &metricInternal{
-				desc:   prometheus.NewDesc(key, "", labels, nil),
+				desc:   prometheus.NewDesc(key, common.ResolveHelp(key, ""), labels, nil),
 				Metric: metric,
 			}
 		}
+		existing.Metric = metric
 		existing.ftsName = metric.Name
+		existing.typ = common.ResolveType(key, metric.Type)
 		c.msi[metric.Name] = existing
 		alive[metric.Name] = true
 	}
@@ -174,4 +254,5 @@ func (c *Collector) updateMSI(ms MetricSet) {
 			delete(c.msi, key)
 		}
 	}
+	c.pindexMSI = pindexMSI
 }
@@ -0,0 +1,71 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fts
+
+import (
+	"context"
+
+	"github.com/couchbase/tools-common/cbrest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+type pindexesResponse struct {
+	PIndexes map[string]struct {
+		IndexName  string `json:"indexName"`
+		SourceName string `json:"sourceName"`
+	} `json:"pindexes"`
+}
+
+type statsResponse struct {
+	PIndexes map[string]map[string]interface{} `json:"pindexes"`
+}
+
+// collectPIndexes emits the stats of each pindex (index partition) hosted on this node, from `/api/stats`. The stats
+// don't say which index each pindex belongs to, so that comes from `/api/pindex`.
+func (c *Collector) collectPIndexes(ctx context.Context, emit common.Emitter) {
+	var pindexes pindexesResponse
+	if err := c.Fetch(ctx, cbrest.ServiceSearch, "/api/pindex", &pindexes); err != nil {
+		c.Logger.Errorw("Failed to get FTS pindexes", "error", err)
+		emit.Error(err)
+		return
+	}
+	var stats statsResponse
+	if err := c.Fetch(ctx, cbrest.ServiceSearch, "/api/stats", &stats); err != nil {
+		c.Logger.Errorw("Failed to get FTS pindex stats", "error", err)
+		emit.Error(err)
+		return
+	}
+	for name, pindexStats := range stats.PIndexes {
+		pindex, ok := pindexes.PIndexes[name]
+		if !ok {
+			c.Logger.Debugw("Stats for unknown pindex, skipping", "pindex", name)
+			continue
+		}
+		if !c.BucketAllowed(pindex.SourceName) {
+			continue
+		}
+		values := make(map[string]interface{})
+		common.FlattenStats("", pindexStats, values)
+		for _, metric := range c.pindexMSI {
+			value, ok := common.ValueOf(values[metric.ftsName], metric.Values)
+			if !ok {
+				continue
+			}
+			emit.TypedMetric(metric.desc, metric.typ, value, pindex.SourceName, pindex.IndexName, name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metrics_test
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake/faketest"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/recording"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/eventing"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/fts"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/gsi"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/memcached"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/n1ql"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/xdcr"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// TestGolden checks the `/metrics` output of the default metric set against the fake cluster of each version. The
+// system collector is left out, as its values come from the machine running the test.
+//
+// Run with -update to regenerate the golden files after an intended change.
+func TestGolden(t *testing.T) {
+	for _, version := range fake.Versions() {
+		version := version
+		t.Run(version, func(t *testing.T) {
+			cluster := faketest.NewCluster(t, version)
+			output := scrape(t, register(goldenCollectors(t, cluster)))
+
+			path := filepath.Join("testdata", "golden", version+".txt")
+			if *update {
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				require.NoError(t, os.WriteFile(path, []byte(output), 0o644))
+				return
+			}
+			expected, err := os.ReadFile(path)
+			require.NoError(t, err, "missing golden file, run with -update to create it")
+			require.Equal(t, string(expected), output)
+		})
+	}
+}
+
+// TestRecordReplay checks that replaying a recorded scrape gives the same output as the scrape itself.
+func TestRecordReplay(t *testing.T) {
+	cluster := faketest.NewCluster(t, "6.6.0")
+	dir := t.TempDir()
+	recorder, err := recording.NewRecorder(zap.NewNop().Sugar(), dir, cluster.Node, 0)
+	require.NoError(t, err)
+	collectors := goldenCollectors(t, cluster)
+	for _, collector := range collectors {
+		collector.SetRecorder(recorder)
+	}
+	recorded := scrape(t, recorder.Gatherer(register(collectors)))
+
+	scrapes, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, scrapes, 1)
+	scrapeDir := filepath.Join(dir, scrapes[0].Name())
+	saved, err := os.ReadFile(filepath.Join(scrapeDir, recording.MetricsFile))
+	require.NoError(t, err)
+	require.Equal(t, recorded, string(saved))
+
+	replay, err := fake.StartClusterFS(os.DirFS(scrapeDir))
+	require.NoError(t, err)
+	defer replay.Close()
+	require.Equal(t, "6.6.0", replay.Version)
+	require.Equal(t, recorded, scrape(t, register(goldenCollectors(t, replay))))
+}
+
+// TestFilters checks that the metrics and buckets that are filtered out are left out of the output.
+func TestFilters(t *testing.T) {
+	cluster := faketest.NewCluster(t, "6.6.0")
+	metricFilter, err := common.NewFilter(nil, []string{"kv_cmd_duration_seconds", "index_.*"})
+	require.NoError(t, err)
+	bucketFilter, err := common.NewFilter(nil, []string{"travel-sample"})
+	require.NoError(t, err)
+	collectors := collectorsFor(t, cluster, metrics.LoadDefaultMetricSet().Filter(metricFilter.Allowed))
+	for _, collector := range collectors {
+		collector.SetBucketFilter(bucketFilter)
+	}
+	output := scrape(t, register(collectors))
+
+	require.NotRegexp(t, `(?m)^(kv_cmd_duration_seconds|index_)`, output)
+	require.NotContains(t, output, `bucket="travel-sample"`)
+	require.Contains(t, output, `bucket="beer-sample"`)
+	require.Regexp(t, `(?m)^kv_ops`, output)
+	require.Regexp(t, `(?m)^fts_`, output)
+}
+
+// scrape returns the `/metrics` output of g.
+func scrape(t *testing.T, g prometheus.Gatherer) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
+
+func register(collectors []common.Collector) *prometheus.Registry {
+	reg := prometheus.NewPedanticRegistry()
+	for _, collector := range collectors {
+		reg.MustRegister(collector)
+	}
+	return reg
+}
+
+// goldenCollectors creates the collectors for the default metric set, with the default options.
+func goldenCollectors(t *testing.T, cluster *fake.Cluster) []common.Collector {
+	t.Helper()
+	return collectorsFor(t, cluster, metrics.LoadDefaultMetricSet())
+}
+
+// collectorsFor creates the collectors for ms, with the default options.
+func collectorsFor(t *testing.T, cluster *fake.Cluster, ms *metrics.MetricSet) []common.Collector {
+	t.Helper()
+	logger := zap.NewNop()
+
+	mc, err := memcached.NewMemcachedMetrics(logger, cluster.Node, ms.Memcached)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = mc.Close() })
+
+	gsiCollector, err := gsi.NewMetrics(logger.Sugar(), cluster.Node, ms.GSI, true, true)
+	require.NoError(t, err)
+
+	n1qlCollector, err := n1ql.NewMetrics(logger.Sugar(), cluster.Node, ms.N1QL, n1ql.DefaultPreparedsLimit)
+	require.NoError(t, err)
+
+	eventingCollector, err := eventing.NewCollector(logger.Sugar(), cluster.Node, ms.Eventing)
+	require.NoError(t, err)
+
+	xdcrCollector, err := xdcr.NewXDCRMetrics(logger.Sugar(), cluster.Node, ms.XDCR)
+	require.NoError(t, err)
+	xdcrCollector.RESTPort = cluster.XDCRPort
+
+	return []common.Collector{
+		mc,
+		gsiCollector,
+		n1qlCollector,
+		fts.NewCollector(logger.Sugar(), cluster.Node, ms.FTS, false),
+		eventingCollector,
+		xdcrCollector,
+	}
+}
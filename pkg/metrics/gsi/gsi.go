@@ -17,42 +17,140 @@ package gsi
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/couchbase/tools-common/cbrest"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 type Metric struct {
-	Name   string `json:"name"`
-	Global bool   `json:"global"`
+	Name   string            `json:"name"`
+	Global bool              `json:"global"`
+	Type   common.MetricType `json:"type"`
+	// Values maps the values of string stats (such as `indexer_state`) to numbers. String values that aren't in it are
+	// skipped.
+	Values map[string]float64 `json:"values"`
+	// Since is the first Couchbase Server version (e.g. `6.5.0`) that exposes this stat. On earlier versions the
+	// metric is skipped without being counted as missing. If unset, the stat is expected on all versions.
+	Since string `json:"since"`
+	// Aggregation is how the values of the partitions of a partitioned index are combined when partitions are
+	// aggregated (one of `sum`, `avg`, or `max`). Defaults to `sum`.
+	Aggregation string `json:"aggregation"`
+	// Source is where the indexer exposes this stat:
+	//   - `stats` (the default) is the `/api/v1/stats` endpoint;
+	//   - `storage` is the storage engine stats (`/stats/storage`), where Name is a dot-separated path into the stats
+	//     of each index (for example `MainStore.resident_ratio`) - these can't be global;
+	//   - `process` is the indexer process stats in the flat `/stats` endpoint - these must be global.
+	// The storage and process endpoints are only queried if at least one metric uses them.
+	Source string `json:"source"`
 }
 
+const (
+	AggregationSum = "sum"
+	AggregationAvg = "avg"
+	AggregationMax = "max"
+)
+
+const (
+	SourceStats   = "stats"
+	SourceStorage = "storage"
+	SourceProcess = "process"
+)
+
 type MetricSet map[string]Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(path, err)
+		}
+		if err := metric.Type.Validate(); err != nil {
+			errs.Add(path+".type", err)
+		}
+		if metric.Since != "" {
+			if _, err := couchbase.ParseVersion(metric.Since); err != nil {
+				errs.Add(path+".since", err)
+			}
+		}
+		switch metric.Aggregation {
+		case "", AggregationSum, AggregationAvg, AggregationMax:
+		default:
+			errs.Addf(path+".aggregation", "unknown aggregation %q", metric.Aggregation)
+		}
+		switch metric.Source {
+		case "", SourceStats:
+		case SourceStorage:
+			if metric.Global {
+				errs.Addf(path+".global", "storage metrics can't be global")
+			}
+		case SourceProcess:
+			if !metric.Global {
+				errs.Addf(path+".global", "process metrics must be global")
+			}
+		default:
+			errs.Addf(path+".source", "unknown source %q", metric.Source)
+		}
+	}
+	return errs.Err()
+}
+
+// Definitions lists the metrics in ms. Their labels depend on the collector's options.
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key := range ms {
+		defs = append(defs, common.Definition{Path: common.JSONPath("", key), Name: key})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if allowed(key) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
 type metricInternal struct {
-	gsiName string
-	global  bool
-	desc    *prometheus.Desc
+	gsiName     string
+	global      bool
+	desc        *prometheus.Desc
+	typ         common.MetricType
+	values      map[string]float64
+	since       *couchbase.Version
+	aggregation string
+	source      string
 }
 
 type metricSetInternal map[string]*metricInternal
 
+// Reasons for a stat being skipped, used as the `reason` label of the skipped stats counter.
+const (
+	skipReasonMissing         = "missing"
+	skipReasonUnsupportedType = "unsupported_type"
+	skipReasonUnexpectedKey   = "unexpected_key"
+)
+
 type Metrics struct {
-	node            couchbase.NodeCommon
-	msi             metricSetInternal
-	mux             sync.Mutex
-	logger          *zap.SugaredLogger
-	fakeCollections bool
+	common.Base
+	msi                 metricSetInternal
+	mux                 sync.Mutex
+	fakeCollections     bool
+	aggregatePartitions bool
+	skipped             *prometheus.CounterVec
+	// sources is the set of sources used by at least one metric.
+	sources map[string]bool
 }
 
 func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
@@ -61,98 +159,123 @@ func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
 	for _, metric := range m.msi {
 		descs <- metric.desc
 	}
+	m.skipped.Describe(descs)
 }
 
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		end := time.Now()
-		m.logger.Infow("Completed GSI collection", zap.Duration("elapsed", end.Sub(start)))
-	}()
-	m.logger.Info("Starting GSI collection")
-	res, err := m.node.RestClient().Do(context.TODO(), &cbrest.Request{
-		Method:             "GET",
-		Endpoint:           "/api/v1/stats",
-		Service:            cbrest.ServiceGSI,
-		ExpectedStatusCode: http.StatusOK,
-	})
+	_ = m.CollectContext(context.Background(), metrics)
+}
+
+func (m *Metrics) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer m.StartCollection()()
+	defer m.skipped.Collect(metrics)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	version, err := m.Node.Version()
 	if err != nil {
-		m.logger.Errorw("Failed to get GSI stats", "err", err)
-		return
+		m.Logger.Warnw("Failed to get node version, assuming all GSI stats are available", "err", err)
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		m.logger.Errorw("Failed to read GSI stats", "err", err)
-		return
+	emit := m.Emitter(metrics)
+	m.collectStats(ctx, emit, version)
+	if m.sources[SourceStorage] {
+		m.collectStorage(ctx, emit, version)
 	}
-	type gsiStatsResult map[string]map[string]interface{}
-	var statsResult gsiStatsResult
-	if err = json.Unmarshal(body, &statsResult); err != nil {
-		m.logger.Errorw("Failed to parse GSI stats", "err", err)
-		return
+	if m.sources[SourceProcess] {
+		m.collectProcess(ctx, emit, version)
 	}
-	const statsKeyGlobal = "indexer"
-	ch, err := m.getMetricsFor(statsResult[statsKeyGlobal], nil, true)
-	if err != nil {
-		m.logger.Errorw("Error while updating global GSI metrics", "err", err)
+	m.Logger.Debug("GSI collection done")
+	return emit.Err()
+}
+
+func (m *Metrics) collectStats(ctx context.Context, emit common.Emitter, version couchbase.Version) {
+	var statsResult map[string]map[string]interface{}
+	if err := m.Fetch(ctx, cbrest.ServiceGSI, "/api/v1/stats", &statsResult); err != nil {
+		m.Logger.Errorw("Failed to get GSI stats", "err", err)
+		emit.Error(err)
 		return
 	}
-	for _, metric := range ch {
-		metrics <- metric
-	}
+	const statsKeyGlobal = "indexer"
+	m.emitMetricsFor(emit, statsResult[statsKeyGlobal], nil, true, version, SourceStats)
+	indexes := make([]indexStats, 0, len(statsResult))
 	for key, vals := range statsResult {
 		if key == statsKeyGlobal {
 			continue
 		}
-		var labels prometheus.Labels
-		parts := strings.Split(key, ":")
-		if len(parts) == 2 {
-			labels = prometheus.Labels{
-				"bucket": parts[0],
-				"index":  parts[1],
-			}
-			if m.fakeCollections {
-				labels["scope"] = "_default"
-				labels["collection"] = "_default"
-			}
-		} else if len(parts) == 4 {
-			labels = prometheus.Labels{
-				"bucket":     parts[0],
-				"scope":      parts[1],
-				"collection": parts[2],
-				"index":      parts[3],
-			}
-		} else {
-			m.logger.Errorw("Unhandled stats name pattern", "key", key)
-			return
-		}
-		results, err := m.getMetricsFor(vals, labels, false)
-		if err != nil {
-			m.logger.Errorw("While updating GSI metrics", "key", key, "err", err)
-			return
+		parsed, ok := parseIndexKey(key)
+		if !ok {
+			m.Logger.Warnw("Unhandled stats name pattern, skipping", "key", key)
+			m.skipped.WithLabelValues("", skipReasonUnexpectedKey).Inc()
+			continue
 		}
-		for _, metric := range results {
-			metrics <- metric
+		if !m.BucketAllowed(parsed.bucket) {
+			continue
 		}
+		indexes = append(indexes, indexStats{key: parsed, values: vals})
 	}
-	m.logger.Debug("GSI collection done")
+	m.emitIndexStats(emit, indexes, version, SourceStats)
+}
+
+// indexStats is the stats of a single index partition, from any source.
+type indexStats struct {
+	key    indexKey
+	values map[string]interface{}
 }
 
-func NewMetrics(logger *zap.SugaredLogger, node couchbase.NodeCommon, ms MetricSet, fakeCollections bool) (*Metrics,
-	error,
+// emitIndexStats maps the given per-index stats to metrics. The stats are first grouped by their labels, so that if
+// we're aggregating partitions, all the partitions of an index end up in the same group. If we aren't, each group will
+// only have one member.
+func (m *Metrics) emitIndexStats(emit common.Emitter, indexes []indexStats, version couchbase.Version,
+	source string,
 ) {
+	type indexGroup struct {
+		labels     prometheus.Labels
+		partitions []map[string]interface{}
+	}
+	groups := make(map[string]*indexGroup)
+	for _, index := range indexes {
+		labels := index.key.labels(m.fakeCollections, m.aggregatePartitions)
+		groupKey := strings.Join(m.labelValues(labels), "\x00")
+		group, ok := groups[groupKey]
+		if !ok {
+			group = &indexGroup{labels: labels}
+			groups[groupKey] = group
+		}
+		group.partitions = append(group.partitions, index.values)
+	}
+	for _, group := range groups {
+		m.emitMetricsFor(emit, m.mergePartitions(group.partitions), group.labels, false, version, source)
+	}
+}
+
+func NewMetrics(logger *zap.SugaredLogger, node couchbase.NodeCommon, ms MetricSet, fakeCollections bool,
+	aggregatePartitions bool,
+) (*Metrics, error) {
 	ret := &Metrics{
-		node:            node,
-		msi:             make(metricSetInternal),
-		logger:          logger,
-		fakeCollections: fakeCollections,
+		Base:                common.NewBase("gsi", logger, node),
+		msi:                 make(metricSetInternal),
+		fakeCollections:     fakeCollections,
+		aggregatePartitions: aggregatePartitions,
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmos_exporter_gsi_skipped_stats_total",
+			Help: "Number of GSI stats that were skipped during collection, by stat name and reason",
+		}, []string{"stat", "reason"}),
+	}
+	if err := ret.updateMetricSet(ms); err != nil {
+		return nil, err
 	}
-	ret.updateMetricSet(ms)
 	return ret, nil
 }
 
-func (m *Metrics) updateMetricSet(ms MetricSet) {
+// Update replaces the metric set, which must be a gsi.MetricSet.
+func (m *Metrics) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(m.Name(), ms)
+	}
+	return m.updateMetricSet(metrics)
+}
+
+func (m *Metrics) updateMetricSet(ms MetricSet) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	alive := make(map[string]bool)
@@ -161,70 +284,93 @@ func (m *Metrics) updateMetricSet(ms MetricSet) {
 		if !ok {
 			var labels []string
 			if !metric.Global {
-				if m.fakeCollections {
-					labels = []string{"bucket", "scope", "collection", "index"}
-				} else {
-					labels = []string{"bucket", "index"}
-				}
+				labels = m.labelNames()
 			}
 			existing = &metricInternal{
-				desc: prometheus.NewDesc(key, "", labels, nil),
+				desc: prometheus.NewDesc(key, common.ResolveHelp(key, ""), labels, nil),
 			}
 		}
 		existing.gsiName = metric.Name
 		existing.global = metric.Global
+		existing.typ = common.ResolveType(key, metric.Type)
+		existing.values = metric.Values
+		existing.aggregation = metric.Aggregation
+		existing.source = metric.Source
+		if existing.source == "" {
+			existing.source = SourceStats
+		}
+		existing.since = nil
+		if metric.Since != "" {
+			since, err := couchbase.ParseVersion(metric.Since)
+			if err != nil {
+				return fmt.Errorf("invalid since for GSI metric %s: %w", key, err)
+			}
+			existing.since = &since
+		}
 		m.msi[key] = existing
 		alive[key] = true
 	}
-	for key := range m.msi {
+	m.sources = make(map[string]bool)
+	for key, metric := range m.msi {
 		if _, ok := alive[key]; !ok {
 			delete(m.msi, key)
+			continue
 		}
+		m.sources[metric.source] = true
 	}
+	return nil
 }
 
-func (m *Metrics) getMetricsFor(values map[string]interface{}, labels prometheus.Labels,
-	global bool,
-) ([]prometheus.Metric, error) {
-	result := make([]prometheus.Metric, 0, len(values))
+// emitMetricsFor maps the given GSI stats from source to metrics. Any configured stat that is missing or has an
+// unexpected type is skipped (and counted), rather than failing the whole collection. version is the version of the
+// node, used to skip metrics that are not expected to be present - if it is the zero Version, all metrics are expected.
+func (m *Metrics) emitMetricsFor(emit common.Emitter, values map[string]interface{}, labels prometheus.Labels,
+	global bool, version couchbase.Version, source string,
+) {
 	for key, metric := range m.msi {
-		if (global && !metric.global) || (!global && metric.global) {
+		if (global && !metric.global) || (!global && metric.global) || metric.source != source {
 			continue
 		}
 		valueTyp, ok := values[metric.gsiName]
 		if !ok {
-			return nil, fmt.Errorf("no GSI metric for expected %s (key %s)", metric.gsiName, key)
-		}
-		var value float64
-		switch vt := valueTyp.(type) {
-		case string:
-			switch key {
-			case "up":
-				if vt == "Active" {
-					value = 1.0
-				} else {
-					value = 0.0
-				}
+			if metric.since != nil && version != (couchbase.Version{}) && version.Less(*metric.since) {
+				continue
 			}
-		case float64:
-			value = vt
-		case int:
-			value = float64(vt)
-		default:
-			return nil, fmt.Errorf("unknown type %t for value %v metric %s (%s)", valueTyp, valueTyp, metric.gsiName,
-				key)
+			m.Logger.Debugw("No GSI stat for expected metric", "gsiName", metric.gsiName, "key", key)
+			m.skipped.WithLabelValues(metric.gsiName, skipReasonMissing).Inc()
+			continue
+		}
+		value, ok := common.ValueOf(valueTyp, metric.values)
+		if !ok {
+			m.Logger.Debugw("Unexpected value for GSI stat", "gsiName", metric.gsiName, "key", key,
+				"value", valueTyp, "valueType", fmt.Sprintf("%T", valueTyp))
+			m.skipped.WithLabelValues(metric.gsiName, skipReasonUnsupportedType).Inc()
+			continue
 		}
 		var labelValues []string
 		if !metric.global {
-			if m.fakeCollections {
-				labelValues = []string{labels["bucket"], labels["scope"], labels["collection"], labels["index"]}
-			} else {
-				labelValues = []string{labels["bucket"], labels["index"]}
-			}
+			labelValues = m.labelValues(labels)
 		}
-		m.logger.Desugar().Debug("Mapped metric", zap.String("gsiName", key), zap.String("desc", metric.desc.String()),
+		m.Logger.Desugar().Debug("Mapped metric", zap.String("gsiName", key), zap.String("desc", metric.desc.String()),
 			zap.Strings("labels", labelValues))
-		result = append(result, prometheus.MustNewConstMetric(metric.desc, prometheus.GaugeValue, value, labelValues...))
+		emit.TypedMetric(metric.desc, metric.typ, value, labelValues...)
+	}
+}
+
+// labelNames returns the names of the labels of per-index metrics, in order.
+func (m *Metrics) labelNames() []string {
+	labels := common.IndexLabelNames(m.fakeCollections)
+	if !m.aggregatePartitions {
+		labels = append(labels, "replica", "partition")
+	}
+	return labels
+}
+
+func (m *Metrics) labelValues(labels prometheus.Labels) []string {
+	names := m.labelNames()
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
 	}
-	return result, nil
+	return values
 }
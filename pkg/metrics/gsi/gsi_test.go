@@ -0,0 +1,91 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gsi
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake/faketest"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// sinceCluster starts a fake cluster of the given version, with an index that has items_count but no cache_hits.
+func sinceCluster(t *testing.T, version string) *fake.Cluster {
+	t.Helper()
+	return faketest.NewClusterFS(t, fstest.MapFS{
+		"management/pools.json": {Data: []byte(`{"implementationVersion": "` + version + `"}`)},
+		"index/api/v1/stats.json": {Data: []byte(`{
+			"indexer": {"indexer_state": "Active"},
+			"travel-sample:def_type": {"items_count": 10}
+		}`)},
+	})
+}
+
+func TestSince(t *testing.T) {
+	ms := MetricSet{
+		"index_items_count": {Name: "items_count", Type: common.MetricGauge},
+		"index_cache_hits":  {Name: "cache_hits", Type: common.MetricCounter, Since: "6.5.0"},
+	}
+	cases := []struct {
+		Version string
+		Missing float64
+	}{
+		// Before 6.5.0 cache_hits isn't expected, so isn't counted as missing.
+		{Version: "6.0.5-3634-enterprise", Missing: 0},
+		{Version: "6.5.1-6299-enterprise", Missing: 1},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Version, func(t *testing.T) {
+			m, err := NewMetrics(zap.NewNop().Sugar(), sinceCluster(t, tc.Version).Node, ms, false, true)
+			require.NoError(t, err)
+			require.Equal(t, 1, testutil.CollectAndCount(m, "index_items_count", "index_cache_hits"))
+			require.Equal(t, tc.Missing,
+				testutil.ToFloat64(m.skipped.WithLabelValues("cache_hits", skipReasonMissing)))
+		})
+	}
+}
+
+func TestStringStats(t *testing.T) {
+	ms := MetricSet{
+		"index_indexer_up": {Name: "indexer_state", Global: true, Type: common.MetricGauge,
+			Values: map[string]float64{"Active": 1, "Warmup": 0}},
+		"index_indexer_state": {Name: "indexer_state", Global: true, Type: common.MetricGauge},
+	}
+	m, err := NewMetrics(zap.NewNop().Sugar(), sinceCluster(t, "6.6.0-7909-enterprise").Node, ms, false, true)
+	require.NoError(t, err)
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string][]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			values[family.GetName()] = append(values[family.GetName()], metric.GetGauge().GetValue())
+		}
+	}
+	require.Equal(t, []float64{1}, values["index_indexer_up"])
+	require.NotContains(t, values, "index_indexer_state")
+	// Without values, the string can't be mapped, so it is skipped rather than emitted as 0.
+	require.Equal(t, 1.0, testutil.ToFloat64(m.skipped.WithLabelValues("indexer_state", skipReasonUnsupportedType)))
+}
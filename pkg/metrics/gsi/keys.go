@@ -0,0 +1,152 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gsi
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// indexKey is a parsed GSI stats key, which identifies a single partition of a single replica of an index.
+//
+// The indexer names its stats `bucket:index` (or `bucket:scope:collection:index` with collections), with a
+// ` (replica N)` suffix on the index name for replicas, and a ` N` suffix for the partitions of a partitioned index.
+type indexKey struct {
+	bucket     string
+	scope      string
+	collection string
+	index      string
+	replica    string
+	partition  string
+}
+
+var (
+	replicaSuffixRe   = regexp.MustCompile(` \(replica (\d+)\)$`)
+	partitionSuffixRe = regexp.MustCompile(` (\d+)$`)
+)
+
+func parseIndexKey(key string) (indexKey, bool) {
+	var result indexKey
+	parts := strings.Split(key, ":")
+	switch len(parts) {
+	case 2:
+		result.bucket, result.index = parts[0], parts[1]
+	case 4:
+		result.bucket, result.scope, result.collection, result.index = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return indexKey{}, false
+	}
+	// The suffixes may come in either order, so keep stripping until neither matches.
+	for {
+		if match := replicaSuffixRe.FindStringSubmatch(result.index); match != nil && result.replica == "" {
+			result.replica = match[1]
+			result.index = strings.TrimSuffix(result.index, match[0])
+			continue
+		}
+		if match := partitionSuffixRe.FindStringSubmatch(result.index); match != nil && result.partition == "" {
+			result.partition = match[1]
+			result.index = strings.TrimSuffix(result.index, match[0])
+			continue
+		}
+		break
+	}
+	if result.index == "" {
+		return indexKey{}, false
+	}
+	if result.replica == "" {
+		result.replica = "0"
+	}
+	return result, true
+}
+
+// labels returns the Prometheus labels for this key.
+//
+// If aggregatePartitions is true, the labels identify the logical index, in the same way as 7.x: the replica is part
+// of the `index` label, and there is no partition label. Otherwise, the replica and partition get their own labels.
+func (k indexKey) labels(fakeCollections, aggregatePartitions bool) prometheus.Labels {
+	labels := prometheus.Labels{
+		"bucket": k.bucket,
+		"index":  k.index,
+	}
+	if k.scope != "" {
+		labels["scope"] = k.scope
+		labels["collection"] = k.collection
+	} else if fakeCollections {
+		labels["scope"] = "_default"
+		labels["collection"] = "_default"
+	}
+	if aggregatePartitions {
+		if k.replica != "0" {
+			labels["index"] = k.index + " (replica " + k.replica + ")"
+		}
+	} else {
+		labels["replica"] = k.replica
+		labels["partition"] = k.partition
+	}
+	return labels
+}
+
+// mergePartitions combines the stats of all the partitions of an index into a single set of stats, using each
+// metric's aggregation.
+func (m *Metrics) mergePartitions(partitions []map[string]interface{}) map[string]interface{} {
+	if len(partitions) == 1 {
+		return partitions[0]
+	}
+	result := make(map[string]interface{})
+	for _, metric := range m.msi {
+		if metric.global {
+			continue
+		}
+		var (
+			sum   float64
+			max   float64
+			count int
+		)
+		for _, vals := range partitions {
+			raw, ok := vals[metric.gsiName]
+			if !ok {
+				continue
+			}
+			value, ok := raw.(float64)
+			if !ok {
+				// Non-numeric stats (such as the index status) can't be combined, so take the first one we see.
+				if _, seen := result[metric.gsiName]; !seen {
+					result[metric.gsiName] = raw
+				}
+				continue
+			}
+			if count == 0 || value > max {
+				max = value
+			}
+			sum += value
+			count++
+		}
+		if count == 0 {
+			continue
+		}
+		switch metric.aggregation {
+		case AggregationAvg:
+			result[metric.gsiName] = sum / float64(count)
+		case AggregationMax:
+			result[metric.gsiName] = max
+		default:
+			result[metric.gsiName] = sum
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gsi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIndexKey(t *testing.T) {
+	cases := []struct {
+		Key      string
+		Expected indexKey
+		OK       bool
+	}{
+		{
+			Key:      "travel-sample:def_type",
+			Expected: indexKey{bucket: "travel-sample", index: "def_type", replica: "0"},
+			OK:       true,
+		},
+		{
+			Key:      "travel-sample:def_type (replica 1)",
+			Expected: indexKey{bucket: "travel-sample", index: "def_type", replica: "1"},
+			OK:       true,
+		},
+		{
+			Key:      "travel-sample:def_type 3",
+			Expected: indexKey{bucket: "travel-sample", index: "def_type", replica: "0", partition: "3"},
+			OK:       true,
+		},
+		{
+			Key:      "travel-sample:def_type 3 (replica 2)",
+			Expected: indexKey{bucket: "travel-sample", index: "def_type", replica: "2", partition: "3"},
+			OK:       true,
+		},
+		{
+			Key:      "travel-sample:def_type (replica 2) 3",
+			Expected: indexKey{bucket: "travel-sample", index: "def_type", replica: "2", partition: "3"},
+			OK:       true,
+		},
+		{
+			Key: "travel-sample:inventory:airline:def_name 1",
+			Expected: indexKey{
+				bucket: "travel-sample", scope: "inventory", collection: "airline", index: "def_name", replica: "0",
+				partition: "1",
+			},
+			OK: true,
+		},
+		{
+			Key: "travel-sample:inventory:def_name",
+			OK:  false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Key, func(t *testing.T) {
+			result, ok := parseIndexKey(tc.Key)
+			require.Equal(t, tc.OK, ok)
+			require.Equal(t, tc.Expected, result)
+		})
+	}
+}
+
+func TestIndexKeyLabels(t *testing.T) {
+	key := indexKey{bucket: "default", index: "idx", replica: "1", partition: "4"}
+	require.Equal(t, "idx (replica 1)", key.labels(false, true)["index"])
+	split := key.labels(true, false)
+	require.Equal(t, "idx", split["index"])
+	require.Equal(t, "1", split["replica"])
+	require.Equal(t, "4", split["partition"])
+	require.Equal(t, "_default", split["scope"])
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gsi
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/couchbase/tools-common/cbrest"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// storageStats is a single entry in the response of `/stats/storage`. There is one for each partition of each index
+// hosted on this node, whether it uses Plasma or MOI storage.
+type storageStats struct {
+	Index       string                 `json:"Index"`
+	PartitionID int                    `json:"PartitionId"`
+	Stats       map[string]interface{} `json:"Stats"`
+}
+
+func (m *Metrics) collectStorage(ctx context.Context, emit common.Emitter, version couchbase.Version) {
+	var result []storageStats
+	if err := m.Fetch(ctx, cbrest.ServiceGSI, "/stats/storage", &result); err != nil {
+		m.Logger.Errorw("Failed to get GSI storage stats", "err", err)
+		emit.Error(err)
+		return
+	}
+	indexes := make([]indexStats, 0, len(result))
+	for _, entry := range result {
+		parsed, ok := parseIndexKey(entry.Index)
+		if !ok {
+			m.Logger.Warnw("Unhandled storage stats index name, skipping", "index", entry.Index)
+			m.skipped.WithLabelValues("", skipReasonUnexpectedKey).Inc()
+			continue
+		}
+		if !m.BucketAllowed(parsed.bucket) {
+			continue
+		}
+		if parsed.partition == "" && entry.PartitionID != 0 {
+			parsed.partition = strconv.Itoa(entry.PartitionID)
+		}
+		values := make(map[string]interface{})
+		common.FlattenStats("", entry.Stats, values)
+		indexes = append(indexes, indexStats{key: parsed, values: values})
+	}
+	m.emitIndexStats(emit, indexes, version, SourceStorage)
+}
+
+// collectProcess collects the indexer process stats (CPU, memory, and so on) from the flat `/stats` endpoint. This also
+// includes every per-index stat (as `bucket:index:stat`), but we only map the global ones from it.
+func (m *Metrics) collectProcess(ctx context.Context, emit common.Emitter, version couchbase.Version) {
+	var result map[string]interface{}
+	if err := m.Fetch(ctx, cbrest.ServiceGSI, "/stats", &result); err != nil {
+		m.Logger.Errorw("Failed to get indexer process stats", "err", err)
+		emit.Error(err)
+		return
+	}
+	m.emitMetricsFor(emit, result, nil, true, version, SourceProcess)
+}
@@ -0,0 +1,315 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package jsonapi is a generic collector for Couchbase REST endpoints that return JSON, where the metrics are defined
+// entirely by the metric set, using JQ-like expressions in the same way as the Eventing collector.
+package jsonapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/couchbase/tools-common/cbrest"
+	"github.com/itchyny/gojq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+type Metric struct {
+	// Expression is a JQ-like (https://github.com/itchyny/gojq) expression over the endpoint's response, which must
+	// evaluate to arrays where the first element is a number (the stat value) and all others are strings, which will
+	// become labels (in the same order as the labels array), or objects with the value under `value` and each label
+	// under its name. See common.EmitExpression for the details.
+	Expression  string            `json:"expression"`
+	Help        string            `json:"help"`
+	Type        common.MetricType `json:"type"`
+	Labels      []string          `json:"labels"`
+	ConstLabels prometheus.Labels `json:"constLabels"`
+}
+
+// Endpoint is a REST endpoint to collect metrics from.
+type Endpoint struct {
+	// Service is the service that serves the endpoint, one of the keys of Services. The endpoint is only collected
+	// from nodes running that service.
+	Service string `json:"service"`
+	// Path is the path of the endpoint, e.g. `/api/v1/stats`.
+	Path string `json:"endpoint"`
+	// Method is the HTTP method to poll the endpoint with, either `GET` (the default) or `POST`.
+	Method string `json:"method" default:"GET"`
+	// Body is the request body, for POST requests.
+	Body string `json:"body"`
+	// Metrics are the metrics to extract from the response, keyed by Prometheus name.
+	Metrics map[string]Metric `json:"metrics"`
+}
+
+// Services are the services that endpoints can be on, by the name used in the metric set.
+var Services = map[string]cbrest.Service{
+	"management": cbrest.ServiceManagement,
+	"kv":         cbrest.ServiceData,
+	"index":      cbrest.ServiceGSI,
+	"query":      cbrest.ServiceQuery,
+	"search":     cbrest.ServiceSearch,
+	"eventing":   cbrest.ServiceEventing,
+	"analytics":  cbrest.ServiceAnalytics,
+	"backup":     cbrest.ServiceBackup,
+}
+
+// MetricSet is keyed by an arbitrary name for each endpoint, which is only used in logs and errors.
+type MetricSet map[string]Endpoint
+
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	seen := make(map[string]string)
+	// Go through the endpoints in order, so that duplicates are reported consistently.
+	names := make([]string, 0, len(ms))
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		endpoint := ms[name]
+		path := common.JSONPath("", name)
+		if _, ok := Services[endpoint.Service]; !ok {
+			errs.Addf(path+".service", "unknown service %q", endpoint.Service)
+		}
+		if endpoint.Path == "" {
+			errs.Addf(path+".endpoint", "no endpoint")
+		}
+		switch endpoint.Method {
+		case "", http.MethodGet:
+			if endpoint.Body != "" {
+				errs.Addf(path+".body", "GET requests can't have a body")
+			}
+		case http.MethodPost:
+		default:
+			errs.Addf(path+".method", "unsupported method %q", endpoint.Method)
+		}
+		for key, metric := range endpoint.Metrics {
+			metricPath := common.JSONPath(path, "metrics", key)
+			if other, ok := seen[key]; ok {
+				errs.Addf(metricPath, "metric %s is also defined by endpoint %s", key, other)
+			}
+			seen[key] = name
+			if err := common.CheckMetricName(key); err != nil {
+				errs.Add(metricPath, err)
+			}
+			if err := metric.Type.Validate(); err != nil {
+				errs.Add(metricPath+".type", err)
+			}
+			if err := common.CheckLabelNames(metric.Labels, metric.ConstLabels); err != nil {
+				errs.Add(metricPath+".labels", err)
+			}
+			if _, err := common.CompileExpression(metric.Expression); err != nil {
+				errs.Add(metricPath+".expression", err)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	var defs []common.Definition
+	for name, endpoint := range ms {
+		for key, metric := range endpoint.Metrics {
+			defs = append(defs, common.Definition{
+				Path:   common.JSONPath("", name, "metrics", key),
+				Name:   key,
+				Labels: common.DefinitionLabels(metric.Labels, metric.ConstLabels),
+			})
+		}
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for. Endpoints left without any metrics
+// are dropped, so that they aren't requested.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for name, endpoint := range ms {
+		metrics := make(map[string]Metric, len(endpoint.Metrics))
+		for key, metric := range endpoint.Metrics {
+			if allowed(key) {
+				metrics[key] = metric
+			}
+		}
+		if len(metrics) > 0 {
+			endpoint.Metrics = metrics
+			result[name] = endpoint
+		}
+	}
+	return result
+}
+
+type metricInternal struct {
+	desc   *prometheus.Desc
+	expr   *gojq.Code
+	typ    common.MetricType
+	labels []string
+}
+
+type endpointInternal struct {
+	Endpoint
+	service cbrest.Service
+	metrics map[string]*metricInternal
+}
+
+type Collector struct {
+	common.Base
+	endpoints map[string]*endpointInternal
+	mux       sync.RWMutex
+	errors    *prometheus.CounterVec
+}
+
+// NewCollector creates a collector for the endpoints in ms whose service is running on node. The others are skipped.
+func NewCollector(logger *zap.SugaredLogger, node couchbase.NodeCommon, ms MetricSet) (*Collector, error) {
+	c := &Collector{
+		Base: common.NewBase("jsonapi", logger, node),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmos_exporter_jsonapi_expression_errors_total",
+			Help: "Number of JSON API expression results that were invalid and skipped, by metric",
+		}, []string{"metric"}),
+	}
+	return c, c.updateMetricSet(ms)
+}
+
+// Empty returns whether there are no endpoints to collect from on this node.
+func (c *Collector) Empty() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return len(c.endpoints) == 0
+}
+
+func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	for _, endpoint := range c.endpoints {
+		for _, metric := range endpoint.metrics {
+			descs <- metric.desc
+		}
+	}
+	c.errors.Describe(descs)
+}
+
+// Update replaces the metric set, which must be a jsonapi.MetricSet.
+func (c *Collector) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(c.Name(), ms)
+	}
+	return c.updateMetricSet(metrics)
+}
+
+func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
+	_ = c.CollectContext(context.Background(), metrics)
+}
+
+func (c *Collector) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer c.StartCollection()()
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	defer c.errors.Collect(metrics)
+	emit := c.Emitter(metrics)
+	for name, endpoint := range c.endpoints {
+		c.collectEndpoint(ctx, emit, name, endpoint)
+	}
+	return emit.Err()
+}
+
+// collectEndpoint can't use Base.Fetch, as endpoints can have any method and a body.
+func (c *Collector) collectEndpoint(ctx context.Context, emit common.Emitter, name string, endpoint *endpointInternal) {
+	req := &cbrest.Request{
+		Method:             endpoint.Method,
+		Service:            endpoint.service,
+		Endpoint:           cbrest.Endpoint(endpoint.Path),
+		ExpectedStatusCode: http.StatusOK,
+		Idempotent:         endpoint.Method == http.MethodGet,
+	}
+	if endpoint.Body != "" {
+		req.Body = []byte(endpoint.Body)
+		req.ContentType = cbrest.ContentType("application/json")
+	}
+	res, err := c.Node.RestClient().ExecuteWithContext(ctx, req)
+	if err != nil {
+		c.Logger.Errorw("Failed to get endpoint", "endpoint", name, "error", err)
+		emit.Error(err)
+		return
+	}
+	c.RecordREST(endpoint.service, endpoint.Path, res.Body)
+	var body interface{}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		c.Logger.Errorw("Failed to unmarshal endpoint response", "endpoint", name, "error", err)
+		emit.Error(err)
+		return
+	}
+	for key, metric := range endpoint.metrics {
+		if failed := common.EmitExpression(c.Logger, emit, key, metric.expr, body, metric.desc, metric.typ,
+			metric.labels); failed > 0 {
+			c.errors.WithLabelValues(key).Add(float64(failed))
+		}
+	}
+}
+
+func (c *Collector) updateMetricSet(ms MetricSet) error {
+	endpoints := make(map[string]*endpointInternal)
+	for name, endpoint := range ms {
+		service, ok := Services[endpoint.Service]
+		if !ok {
+			return fmt.Errorf("jsonapi endpoint %s: unknown service %q", name, endpoint.Service)
+		}
+		if service != cbrest.ServiceManagement {
+			has, err := c.Node.HasService(service)
+			if err != nil {
+				return fmt.Errorf("failed to check service for jsonapi endpoint %s: %w", name, err)
+			}
+			if !has {
+				c.Logger.Infow("Service is not running on this node, skipping endpoint", "endpoint", name,
+					"service", endpoint.Service)
+				continue
+			}
+		}
+		if endpoint.Method == "" {
+			endpoint.Method = http.MethodGet
+		}
+		ei := &endpointInternal{
+			Endpoint: endpoint,
+			service:  service,
+			metrics:  make(map[string]*metricInternal),
+		}
+		for key, metric := range endpoint.Metrics {
+			code, err := common.CompileExpression(metric.Expression)
+			if err != nil {
+				return fmt.Errorf("jsonapi endpoint %s metric %s: %w", name, key, err)
+			}
+			ei.metrics[key] = &metricInternal{
+				desc:   prometheus.NewDesc(key, common.ResolveHelp(key, metric.Help), metric.Labels, metric.ConstLabels),
+				expr:   code,
+				typ:    common.ResolveType(key, metric.Type),
+				labels: metric.Labels,
+			}
+		}
+		endpoints[name] = ei
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.endpoints = endpoints
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package jsonapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricSetValidate(t *testing.T) {
+	metric := Metric{Expression: `[.heap_used]`, Type: "gauge"}
+	cases := []struct {
+		Name  string
+		MS    MetricSet
+		Error string
+	}{
+		{
+			Name: "valid",
+			MS: MetricSet{
+				"analytics": {Service: "analytics", Path: "/analytics/node/stats", Metrics: map[string]Metric{
+					"cbas_heap_used": metric,
+				}},
+			},
+		},
+		{
+			Name:  "unknown service",
+			MS:    MetricSet{"x": {Service: "cbas", Path: "/x"}},
+			Error: `unknown service "cbas"`,
+		},
+		{
+			Name:  "no endpoint",
+			MS:    MetricSet{"x": {Service: "analytics"}},
+			Error: "no endpoint",
+		},
+		{
+			Name:  "GET with a body",
+			MS:    MetricSet{"x": {Service: "query", Path: "/query/service", Body: "{}"}},
+			Error: "can't have a body",
+		},
+		{
+			Name: "bad expression",
+			MS: MetricSet{"x": {Service: "analytics", Path: "/x", Metrics: map[string]Metric{
+				"x": {Expression: "[.a"},
+			}}},
+			Error: "invalid expression",
+		},
+		{
+			Name: "duplicate metric",
+			MS: MetricSet{
+				"a": {Service: "analytics", Path: "/a", Metrics: map[string]Metric{"x": metric}},
+				"b": {Service: "analytics", Path: "/b", Metrics: map[string]Metric{"x": metric}},
+			},
+			Error: "is also defined by endpoint",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.MS.Validate()
+			if tc.Error == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.Error)
+		})
+	}
+}
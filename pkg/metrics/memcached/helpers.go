@@ -17,7 +17,6 @@ package memcached
 
 import (
 	"encoding/json"
-	"fmt"
 
 	"github.com/couchbase/gomemcached"
 )
@@ -25,19 +24,20 @@ import (
 type mcOpcode struct {
 	code gomemcached.CommandCode
 	name string
+	// known is false for names that gomemcached doesn't have an opcode for, which MetricSet.Validate reports.
+	known bool
 }
 
 func (m *mcOpcode) UnmarshalJSON(bytes []byte) error {
-	var name string
-	if err := json.Unmarshal(bytes, &name); err != nil {
+	if err := json.Unmarshal(bytes, &m.name); err != nil {
 		return err
 	}
 	for code, opName := range gomemcached.CommandNames {
-		if opName == name {
+		if opName == m.name {
 			m.code = code
-			m.name = name
+			m.known = true
 			return nil
 		}
 	}
-	return fmt.Errorf("unknown memcached opcode %s", name)
+	return nil
 }
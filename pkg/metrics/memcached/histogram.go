@@ -16,6 +16,7 @@
 package memcached
 
 import (
+	"fmt"
 	"math"
 	"sort"
 	"strconv"
@@ -23,6 +24,8 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 type histogram struct {
@@ -91,20 +94,17 @@ func (h *histogram) resample(newUpperBounds []float64) {
 	h.buckets = resampled
 }
 
-func (h histogram) metric() prometheus.Metric {
-	return prometheus.MustNewConstHistogram(
-		h.desc,
-		h.count,
-		h.sum,
-		h.buckets,
-		h.labels...,
-	)
+func (h histogram) emit(emit common.Emitter) {
+	emit.Histogram(h.desc, h.count, h.sum, h.buckets, h.labels...)
 }
 
 func findBounds(key string) (time.Duration, time.Duration, error) {
 	lastUnderscoreIdx := strings.LastIndexByte(key, '_')
 	bucketBounds := key[lastUnderscoreIdx+1:]
 	commaIdx := strings.IndexRune(bucketBounds, ',')
+	if commaIdx < 0 {
+		return 0, 0, fmt.Errorf("histogram stat %q has no bucket bounds", key)
+	}
 	lowerBound, err := strconv.ParseFloat(bucketBounds[:commaIdx], 64)
 	if err != nil {
 		return 0, 0, err
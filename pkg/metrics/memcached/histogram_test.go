@@ -18,6 +18,7 @@ package memcached
 import (
 	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -88,3 +89,15 @@ func TestHistogramResample(t *testing.T) {
 		})
 	}
 }
+
+func TestFindBounds(t *testing.T) {
+	lower, upper, err := findBounds("bg_wait_0,10")
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), lower)
+	require.Equal(t, 10*time.Microsecond, upper)
+
+	for _, key := range []string{"bg_wait_10", "bg_wait", "bg_wait_a,10", "bg_wait_0,b"} {
+		_, _, err := findBounds(key)
+		require.Error(t, err, key)
+	}
+}
@@ -16,7 +16,9 @@
 package memcached
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
@@ -58,8 +60,10 @@ type MetricConfig struct {
 	// ConstLabels are constant labels to apply to the metric, in addition to Labels.
 	ConstLabels prometheus.Labels `json:"constLabels"`
 	// Help is the help string to add to the emitted Prometheus metric.
+	// If unset, it is taken from the bundled metrics metadata.
 	Help string `json:"help,omitempty"`
-	// Type is the type of metric to emit (counter, gauge, histogram, untyped). Defaults to untyped.
+	// Type is the type of metric to emit (counter, gauge, histogram, untyped).
+	// If unset, it is taken from the bundled metrics metadata, and defaults to untyped if that has none.
 	Type common.MetricType `json:"type"`
 	// Multiplier is a constant by which to multiply the resulting stats value.
 	// For example, it can be used to fix values that are milliseconds in 6.0 but seconds in 7.0,
@@ -79,6 +83,8 @@ type MetricConfig struct {
 // MetricConfigs allows a JSON metric config to be either an object or an array.
 type MetricConfigs struct {
 	Values []MetricConfig
+	// array is whether the config was an array, for the paths of validation errors.
+	array bool
 }
 
 func (m *MetricConfigs) UnmarshalJSON(bytes []byte) error {
@@ -91,12 +97,17 @@ func (m *MetricConfigs) UnmarshalJSON(bytes []byte) error {
 		m.Values = []MetricConfig{val}
 		return nil
 	case '[':
+		m.array = true
 		return json.Unmarshal(bytes, &m.Values)
 	default:
 		return fmt.Errorf("invalid input for MetricConfigs")
 	}
 }
 
+const commandTimingsMetricName = "kv_cmd_duration_seconds"
+
+var commandTimingsLabels = []string{"bucket", "opcode"}
+
 type commandTimingMetricConfig struct {
 	Opcodes         []mcOpcode `json:"opcodes"`
 	ResampleBuckets []float64  `json:"resampleBuckets"`
@@ -111,6 +122,120 @@ type MetricSet struct {
 	CommandTimings *commandTimingMetricConfig `json:"commandTimings"`
 }
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, configs := range ms.Stats {
+		keyPath := common.JSONPath("", "stats", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(keyPath, err)
+		}
+		for i, metric := range configs.Values {
+			path := keyPath
+			if configs.array {
+				path = common.JSONPath(path, i)
+			}
+			if err := metric.Type.Validate(common.MetricHistogram); err != nil {
+				errs.Add(path+".type", err)
+			}
+			exp, err := regexp.Compile(metric.Pattern)
+			if err != nil {
+				errs.Add(path+".pattern", err)
+			}
+			labels := make([]string, len(metric.Labels))
+			for j, label := range metric.Labels {
+				name, transform := splitLabel(label)
+				labels[j] = name
+				switch transform {
+				case "", "uppercase", "lowercase":
+				default:
+					errs.Addf(common.JSONPath(path, "labels", j), "unknown label transform %q", transform)
+				}
+				// bucket always has a value, as do scope and collection when faking collections.
+				if exp != nil && name != "bucket" && name != "scope" && name != "collection" &&
+					exp.SubexpIndex(name) == -1 {
+					errs.Addf(common.JSONPath(path, "labels", j), "pattern has no named group for label %q", name)
+				}
+			}
+			if err := common.CheckLabelNames(labels, metric.ConstLabels); err != nil {
+				errs.Add(path+".labels", err)
+			}
+			// The configs of a key can have different labels (like 7.x's kv_ops), but they are one metric family, so
+			// Prometheus rejects them if their types or help differ.
+			if i > 0 {
+				first := configs.Values[0]
+				typ, firstType := common.ResolveType(key, metric.Type), common.ResolveType(key, first.Type)
+				if typ != firstType {
+					errs.Addf(path+".type", "type %s conflicts with the type %s of the key's first config", typ,
+						firstType)
+				}
+				if common.ResolveHelp(key, metric.Help) != common.ResolveHelp(key, first.Help) {
+					errs.Addf(path+".help", "help conflicts with the help of the key's first config")
+				}
+			}
+		}
+	}
+	if ms.CommandTimings != nil {
+		for i, opcode := range ms.CommandTimings.Opcodes {
+			if !opcode.known {
+				errs.Addf(common.JSONPath("", "commandTimings", "opcodes", i), "unknown memcached opcode %q",
+					opcode.name)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms.Stats)+1)
+	for key, configs := range ms.Stats {
+		if len(configs.Values) == 0 {
+			continue
+		}
+		// The other configs may have different labels, which only matters if another collector defines the metric.
+		metric := configs.Values[0]
+		labels := make([]string, len(metric.Labels))
+		for i, label := range metric.Labels {
+			labels[i], _ = splitLabel(label)
+		}
+		defs = append(defs, common.Definition{
+			Path:   common.JSONPath("", "stats", key),
+			Name:   key,
+			Labels: common.DefinitionLabels(labels, metric.ConstLabels),
+		})
+	}
+	if ms.CommandTimings != nil {
+		defs = append(defs, common.Definition{
+			Path:   ".commandTimings",
+			Name:   commandTimingsMetricName,
+			Labels: common.DefinitionLabels(commandTimingsLabels, nil),
+		})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for. The command timings are dropped
+// unless kv_cmd_duration_seconds is allowed, so that they aren't requested.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := MetricSet{Stats: make(map[string]MetricConfigs, len(ms.Stats))}
+	for key, configs := range ms.Stats {
+		if allowed(key) {
+			result.Stats[key] = configs
+		}
+	}
+	if ms.CommandTimings != nil && allowed(commandTimingsMetricName) {
+		result.CommandTimings = ms.CommandTimings
+	}
+	return result
+}
+
+// splitLabel splits a label of a MetricConfig into its name and transform, which is blank if it has none.
+func splitLabel(label string) (string, string) {
+	if idx := strings.IndexByte(label, ':'); idx >= 0 {
+		return label[:idx], label[idx+1:]
+	}
+	return label, ""
+}
+
 type internalStat struct {
 	MetricConfig
 	name       string
@@ -119,20 +244,39 @@ type internalStat struct {
 	multiplier float64
 }
 
-// internalStatsMap is a map of Memcached STAT groups to metrics.
+// internalStatsMap is a map of Memcached STAT groups to metrics. The metrics of each group are sorted by name.
 type internalStatsMap map[string][]*internalStat
 
+// groups returns the STAT groups, sorted, so that they are always collected in the same order. Along with the metrics
+// and stats being sorted, this means that the series limits always keep the same series.
+func (s internalStatsMap) groups() []string {
+	groups := make([]string, 0, len(s))
+	for group := range s {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
 type Metrics struct {
 	FakeCollections bool
-	node            couchbase.NodeCommon
-	hostPort        string
-	stats           internalStatsMap
-	commandTimings  *commandTimingMetricConfig
-	mc              *memcached.Client
-	ms              MetricSet
-	mux             sync.Mutex
-	logger          *zap.Logger
-	opaqueInc       *atomic.Uint32
+	// BucketSeriesLimit is the maximum number of series to emit for each bucket, and SeriesLimit the maximum for all
+	// of them. Collection of a bucket stops once either is reached. Zero means no limit.
+	BucketSeriesLimit int
+	SeriesLimit       int
+	common.Base
+	hostPort       string
+	stats          internalStatsMap
+	commandTimings *commandTimingMetricConfig
+	mc             *memcached.Client
+	ms             MetricSet
+	mux            sync.Mutex
+	logger         *zap.Logger
+	opaqueInc      *atomic.Uint32
+	bucketErrors   *prometheus.CounterVec
+	// bucketLimitDesc and limitDesc are the flags of whether BucketSeriesLimit and SeriesLimit were reached.
+	bucketLimitDesc *prometheus.Desc
+	limitDesc       *prometheus.Desc
 }
 
 func (m *Metrics) Describe(_ chan<- *prometheus.Desc) {
@@ -143,65 +287,128 @@ func (m *Metrics) Describe(_ chan<- *prometheus.Desc) {
 	// and kv_ops{bucket="travel-sample",result="hit",op="get"} simultaneously.
 }
 
+// Update replaces the metric set, which must be a memcached.MetricSet.
+func (m *Metrics) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(m.Name(), ms)
+	}
+	return m.updateMetricSet(metrics)
+}
+
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		end := time.Now()
-		m.logger.Info("Completed memcached collection", zap.Duration("elapsed", end.Sub(start)))
-	}()
-	m.logger.Info("Starting memcached collection")
+	_ = m.CollectContext(context.Background(), metrics)
+}
+
+// CollectContext stops before the next bucket once ctx is done. The memcached client doesn't support contexts, so
+// the requests for the current bucket are always completed.
+func (m *Metrics) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer m.StartCollection()()
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.bucketErrors.Collect(metrics)
+	emit := m.Emitter(metrics)
 	// gomemcached doesn't have a ListBuckets method (neither does gocbcore for that matter)
 	res, err := m.mc.Send(&gomemcached.MCRequest{
 		Opcode: 0x87, // https://github.com/couchbase/kv_engine/blob/bb8b64eb180b01b566e2fbf54b969e6d20b2a873/docs/BinaryProtocol.md#0x87-list-buckets
 	})
 	if err != nil {
 		m.logger.Error("When listing buckets", zap.Error(err))
-		return
+		emit.Error(err)
+		return emit.Err()
 	}
 	if res == nil {
 		m.logger.Error("Memcached gave nil response to ListBuckets")
-		return
+		emit.Error(errors.New("nil response to ListBuckets"))
+		return emit.Err()
 	}
 	buckets := strings.Split(string(res.Body), " ")
 	if len(buckets) == 1 && buckets[0] == "" {
 		buckets = nil
 	}
 	m.logger.Debug("Got buckets", zap.Strings("buckets", buckets))
+	limit := common.NewSeriesLimit(m.SeriesLimit)
 	singletons := make(map[string]struct{})
 	for _, bucket := range buckets {
-		_, err = m.mc.SelectBucket(bucket)
-		if err != nil {
-			m.logger.Error("When selecting bucket", zap.String("bucket", bucket), zap.Error(err))
+		if !m.BucketAllowed(bucket) {
+			m.logger.Debug("Skipping filtered bucket", zap.String("bucket", bucket))
+			continue
 		}
-		m.logger.Debug("Selected bucket", zap.String("bucket", bucket))
-		for group := range m.stats {
-			m.logger.Debug("Requesting stats for", zap.String("group", group))
-			allStats, err := m.mc.StatsMap(group)
-			if err != nil {
-				m.logger.Error("When requesting stats map", zap.String("bucket", bucket), zap.String("group", group),
-					zap.Error(err))
-				continue
-			}
-			if err := m.processStatGroup(metrics, bucket, group, allStats, singletons); err != nil {
-				m.logger.Error("When requesting stats map", zap.String("bucket", bucket), zap.String("group", group),
-					zap.Error(err))
-				continue
-			}
+		if err := ctx.Err(); err != nil {
+			m.logger.Warn("Abandoning memcached collection", zap.String("bucket", bucket), zap.Error(err))
+			emit.Error(err)
+			return emit.Err()
 		}
+		bucketEmit := emit.WithLimits(common.NewSeriesLimit(m.BucketSeriesLimit), limit)
+		// Once the overall limit is reached, the remaining buckets aren't collected at all.
+		if !limit.Reached() {
+			m.collectBucket(bucketEmit, bucket, singletons)
+		}
+		if m.BucketSeriesLimit > 0 || m.SeriesLimit > 0 {
+			emit.Metric(m.bucketLimitDesc, prometheus.GaugeValue, boolValue(bucketEmit.LimitReached()), bucket)
+		}
+	}
+	if m.SeriesLimit > 0 {
+		emit.Metric(m.limitDesc, prometheus.GaugeValue, boolValue(limit.Reached()))
+	}
+	return emit.Err()
+}
 
-		if m.commandTimings != nil {
-			if err := m.processCommandTimings(metrics, bucket); err != nil {
-				m.logger.Error("Failed to process command timings", zap.String("bucket", bucket), zap.Error(err))
-			}
+// collectBucket collects the stats of bucket. Errors are logged and counted by bucket, and only skip the stats they
+// affect, or the whole bucket if it can't be selected.
+func (m *Metrics) collectBucket(emit common.Emitter, bucket string, singletons map[string]struct{}) {
+	_, err := m.mc.SelectBucket(bucket)
+	if err != nil {
+		m.logger.Error("When selecting bucket", zap.String("bucket", bucket), zap.Error(err))
+		m.bucketErrors.WithLabelValues(bucket).Inc()
+		emit.Error(err)
+		return
+	}
+	m.logger.Debug("Selected bucket", zap.String("bucket", bucket))
+	for _, group := range m.stats.groups() {
+		if emit.LimitReached() {
+			break
+		}
+		m.logger.Debug("Requesting stats for", zap.String("group", group))
+		allStats, err := m.mc.StatsMap(group)
+		if err != nil {
+			m.logger.Error("When requesting stats map", zap.String("bucket", bucket), zap.String("group", group),
+				zap.Error(err))
+			m.bucketErrors.WithLabelValues(bucket).Inc()
+			emit.Error(err)
+			continue
 		}
+		m.RecordStats(bucket, group, allStats)
+		m.processStatGroup(emit, bucket, group, allStats, singletons)
+	}
+
+	if m.commandTimings != nil && !emit.LimitReached() {
+		if err := m.processCommandTimings(emit, bucket); err != nil {
+			m.logger.Error("Failed to process command timings", zap.String("bucket", bucket), zap.Error(err))
+			m.bucketErrors.WithLabelValues(bucket).Inc()
+			emit.Error(err)
+		}
+	}
+	if emit.LimitReached() {
+		m.logger.Warn("Series limit reached, skipped the rest of the bucket", zap.String("bucket", bucket))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
 	}
+	return 0
 }
 
-func (m *Metrics) processStatGroup(metrics chan<- prometheus.Metric, bucket string, groupName string, vals map[string]string,
+func (m *Metrics) processStatGroup(emit common.Emitter, bucket string, groupName string, vals map[string]string,
 	singletons map[string]struct{},
-) error {
+) {
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	for _, metric := range m.stats[groupName] {
 		// Skip singleton metrics we've already seen
 		if metric.Singleton {
@@ -212,25 +419,29 @@ func (m *Metrics) processStatGroup(metrics chan<- prometheus.Metric, bucket stri
 		var err error
 		switch metric.Type {
 		case common.MetricHistogram:
-			err = m.mapHistogramStat(metrics, bucket, vals, metric)
+			err = m.mapHistogramStat(emit, bucket, keys, vals, metric)
 		default:
-			err = m.mapValueStat(metrics, bucket, vals, metric)
+			err = m.mapValueStat(emit, bucket, keys, vals, metric)
 		}
 		if err != nil {
-			m.logger.Warn("Failed to process stat", zap.String("metric", metric.name), zap.Error(err))
+			m.logger.Warn("Failed to process stat", zap.String("bucket", bucket), zap.String("metric", metric.name),
+				zap.Error(err))
+			m.bucketErrors.WithLabelValues(bucket).Inc()
+			emit.Error(err)
 			continue
 		}
 		if metric.Singleton {
 			singletons[metric.name] = struct{}{}
 		}
 	}
-	return nil
 }
 
-func (m *Metrics) mapValueStat(metrics chan<- prometheus.Metric, bucket string, statsValues map[string]string,
+// mapValueStat emits the stats that match metric. keys are the sorted keys of statsValues.
+func (m *Metrics) mapValueStat(emit common.Emitter, bucket string, keys []string, statsValues map[string]string,
 	metric *internalStat,
 ) error {
-	for key, valStr := range statsValues {
+	for _, key := range keys {
+		valStr := statsValues[key]
 		if match := metric.exp.FindStringSubmatch(key); match != nil {
 			val, err := strconv.ParseFloat(valStr, 64)
 			if err != nil {
@@ -239,67 +450,65 @@ func (m *Metrics) mapValueStat(metrics chan<- prometheus.Metric, bucket string,
 			labelValues := m.resolveLabelValues(bucket, metric, match)
 			// m.logger.Debug("Mapped metric", zap.String("memcached_name", key), zap.String("prom_name", metric.name),
 			//	zap.Strings("labels", labelValues))
-			metrics <- prometheus.MustNewConstMetric(
-				metric.desc,
-				metric.Type.ToPrometheus(),
-				val*metric.multiplier,
-				labelValues...,
-			)
+			emit.TypedMetric(metric.desc, metric.Type, val*metric.multiplier, labelValues...)
 		}
 	}
 	return nil
 }
 
-func (m *Metrics) mapHistogramStat(metrics chan<- prometheus.Metric, bucket string, vals map[string]string,
+// mapHistogramStat emits a histogram for each stat that matches metric. keys are the sorted keys of vals.
+func (m *Metrics) mapHistogramStat(emit common.Emitter, bucket string, keys []string, vals map[string]string,
 	metric *internalStat,
 ) error {
-	matchedKeys := make([]string, 0)
-	for key := range vals {
-		if metric.exp.MatchString(key) {
-			matchedKeys = append(matchedKeys, key)
+	type histogramKey struct {
+		key                    string
+		lowerBound, upperBound time.Duration
+	}
+	matchedKeys := make([]histogramKey, 0)
+	for _, key := range keys {
+		if !metric.exp.MatchString(key) {
+			continue
+		}
+		lowerBound, upperBound, err := findBounds(key)
+		if err != nil {
+			return err
 		}
+		matchedKeys = append(matchedKeys, histogramKey{key: key, lowerBound: lowerBound, upperBound: upperBound})
 	}
 	if len(matchedKeys) == 0 {
 		return nil
 	}
 
-	sort.Slice(matchedKeys, func(i, j int) bool {
-		lbI, _, err := findBounds(matchedKeys[i])
-		if err != nil {
-			panic(err)
-		}
-		lbJ, _, err := findBounds(matchedKeys[j])
-		if err != nil {
-			panic(err)
-		}
-		return lbI < lbJ
+	sort.SliceStable(matchedKeys, func(i, j int) bool {
+		return matchedKeys[i].lowerBound < matchedKeys[j].lowerBound
 	})
 
 	histograms := make(map[string]*histogram)
-	for _, key := range matchedKeys {
+	var order []string
+	for _, matched := range matchedKeys {
+		key := matched.key
 		lastUnderscoreIdx := strings.LastIndexByte(key, '_')
 		statName := key[:lastUnderscoreIdx]
 		histo, ok := histograms[statName]
 		if !ok {
 			histo = newHistogram(metric.desc, m.resolveLabelValues(bucket, metric, metric.exp.FindStringSubmatch(key))...)
 			histograms[statName] = histo
-		}
-		lowerBound, upperBound, err := findBounds(key)
-		if err != nil {
-			return err
+			order = append(order, statName)
 		}
 		val, err := strconv.ParseUint(vals[key], 10, 64)
 		if err != nil {
 			return err
 		}
-		histo.addReadings(lowerBound.Seconds()*metric.Multiplier, upperBound.Seconds()*metric.Multiplier, val)
+		histo.addReadings(matched.lowerBound.Seconds()*metric.Multiplier, matched.upperBound.Seconds()*metric.Multiplier,
+			val)
 	}
 
-	for _, histo := range histograms {
+	for _, statName := range order {
+		histo := histograms[statName]
 		if len(metric.ResampleBuckets) > 0 {
 			histo.resample(metric.ResampleBuckets)
 		}
-		metrics <- histo.metric()
+		histo.emit(emit)
 	}
 	return nil
 }
@@ -337,10 +546,13 @@ func (m *Metrics) resolveLabelValues(bucket string, metric *internalStat, match
 				labelValues[i] = transformFn(match[metric.exp.SubexpIndex(label)])
 			}
 		default:
-			if metric.exp.SubexpIndex(label) == -1 {
+			// Validate rejects labels without a sub-expression, but don't index out of range if one gets through.
+			idx := metric.exp.SubexpIndex(label)
+			if idx == -1 {
 				m.logger.Warn("Missing sub-expression for label match", zap.String("label", label), zap.Strings("match", match), zap.String("metric", metric.name))
+				continue
 			}
-			labelValues[i] = transformFn(match[metric.exp.SubexpIndex(label)])
+			labelValues[i] = transformFn(match[idx])
 		}
 	}
 	return labelValues
@@ -365,12 +577,22 @@ func NewMemcachedMetrics(logger *zap.Logger, node couchbase.NodeCommon, metricSe
 	if err != nil {
 		return nil, err
 	}
+	base := common.NewBase("memcached", logger.Sugar(), node)
 	ret := &Metrics{
-		node:      node,
+		Base:      base,
 		mc:        mc,
 		hostPort:  hostPort,
-		logger:    logger,
+		logger:    base.Logger.Desugar(),
 		opaqueInc: atomic.NewUint32(0),
+		bucketErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmos_exporter_bucket_scrape_errors_total",
+			Help: "Number of errors collecting the KV stats of a bucket, each of which skipped some of its metrics",
+		}, []string{"bucket"}),
+		bucketLimitDesc: prometheus.NewDesc("cmos_exporter_kv_bucket_series_limit_reached",
+			"Whether collection of the bucket's KV stats stopped at the per-bucket or overall series limit",
+			[]string{"bucket"}, nil),
+		limitDesc: prometheus.NewDesc("cmos_exporter_kv_series_limit_reached",
+			"Whether collection of KV stats stopped at the overall series limit", nil, nil),
 	}
 	if err = ret.updateMetricSet(metricSet); err != nil {
 		return nil, err
@@ -393,17 +615,14 @@ func (m *Metrics) updateMetricSet(ms MetricSet) error {
 			}
 			labels := make([]string, len(val.Labels))
 			for i, label := range val.Labels {
-				if strings.ContainsRune(label, ':') {
-					parts := strings.SplitN(label, ":", 2)
-					labels[i] = parts[0]
-				} else {
-					labels[i] = label
-				}
+				labels[i], _ = splitLabel(label)
 			}
 			multiplier := val.Multiplier
 			if multiplier == 0 {
 				multiplier = 1
 			}
+			val.Help = common.ResolveHelp(metric, val.Help)
+			val.Type = common.ResolveType(metric, val.Type)
 			stat := internalStat{
 				MetricConfig: val,
 				name:         metric,
@@ -417,14 +636,18 @@ func (m *Metrics) updateMetricSet(ms MetricSet) error {
 		}
 	}
 
+	for _, stats := range statsMap {
+		sort.SliceStable(stats, func(i, j int) bool {
+			return stats[i].name < stats[j].name
+		})
+	}
+
 	m.ms = ms
 	m.stats = statsMap
 	if ms.CommandTimings != nil {
 		m.commandTimings = &*ms.CommandTimings
-		m.commandTimings.desc = prometheus.NewDesc("kv_cmd_duration_seconds", "command durations", []string{
-			"bucket",
-			"opcode",
-		}, nil)
+		m.commandTimings.desc = prometheus.NewDesc(commandTimingsMetricName, common.ResolveHelp(commandTimingsMetricName, ""),
+			commandTimingsLabels, nil)
 	} else {
 		m.commandTimings = nil
 	}
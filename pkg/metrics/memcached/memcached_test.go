@@ -0,0 +1,184 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package memcached
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/couchbase/fake/faketest"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+func TestMetricSetValidate(t *testing.T) {
+	var ms MetricSet
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"stats": {
+			"kv_ops": [
+				{"pattern": "^cmd_(?P<op>set)$", "labels": ["bucket", "op"], "type": "counter"},
+				{"pattern": "^(?P<op>get)_(?P<result>hit)s$", "labels": ["bucket", "op", "result"], "type": "counter"}
+			],
+			"kv_bad": {"pattern": "^(?P<op>a", "labels": ["bucket", "op:upper", "missing"]},
+			"kv_types": [
+				{"pattern": "^a$", "labels": ["bucket"], "type": "counter"},
+				{"pattern": "^b$", "labels": ["bucket"], "type": "gauge"}
+			],
+			"kv_groups": {"pattern": "^x_(?P<op>.+)$", "labels": ["bucket", "op:lowercase", "missing"]}
+		},
+		"commandTimings": {"opcodes": ["GET", "NOT_AN_OPCODE"]}
+	}`), &ms))
+
+	err := ms.Validate()
+	var errs common.ValidationErrors
+	require.ErrorAs(t, err, &errs)
+	paths := make(map[string]string)
+	for _, problem := range errs {
+		paths[problem.Path] = problem.Err.Error()
+	}
+	// kv_ops's configs have different labels, which is fine.
+	require.Len(t, paths, 5, err.Error())
+	require.Contains(t, paths[".stats.kv_bad.pattern"], "missing closing )")
+	require.Contains(t, paths[".stats.kv_bad.labels[1]"], `unknown label transform "upper"`)
+	require.Contains(t, paths[".stats.kv_groups.labels[2]"], `no named group for label "missing"`)
+	require.Contains(t, paths[".stats.kv_types[1].type"], "conflicts")
+	require.Contains(t, paths[".commandTimings.opcodes[1]"], "NOT_AN_OPCODE")
+}
+
+// limitsCluster starts a fake 6.6.0 cluster where beer-sample's curr_items stat isn't a number.
+func limitsCluster(t *testing.T) *fake.Cluster {
+	t.Helper()
+	fsys := faketest.Payloads(t, "6.6.0")
+	var stats map[string]map[string]string
+	require.NoError(t, json.Unmarshal(fsys["kv/beer-sample/stats.json"].Data, &stats))
+	stats[""]["curr_items"] = "oops"
+	data, err := json.Marshal(stats)
+	require.NoError(t, err)
+	fsys["kv/beer-sample/stats.json"].Data = data
+	return faketest.NewClusterFS(t, fsys)
+}
+
+func TestBucketErrorsAndLimits(t *testing.T) {
+	cluster := limitsCluster(t)
+	ms := MetricSet{Stats: map[string]MetricConfigs{
+		// 12 series for each bucket.
+		"kv_vb_stat": {Values: []MetricConfig{
+			{Pattern: "^vb_(?P<stat>.+)$", Labels: []string{"bucket", "stat"}, Type: common.MetricGauge},
+		}},
+		// 1 series, for travel-sample only.
+		"kv_curr_items": {Values: []MetricConfig{
+			{Pattern: "^curr_items$", Labels: []string{"bucket"}, Type: common.MetricGauge},
+		}},
+	}}
+	newCollector := func(bucketLimit, limit int) *Metrics {
+		m, err := NewMemcachedMetrics(zap.NewNop(), cluster.Node, ms)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = m.Close() })
+		m.BucketSeriesLimit = bucketLimit
+		m.SeriesLimit = limit
+		return m
+	}
+	flags := []string{"cmos_exporter_kv_bucket_series_limit_reached", "cmos_exporter_kv_series_limit_reached"}
+
+	m := newCollector(0, 0)
+	require.Equal(t, 25, testutil.CollectAndCount(m, "kv_vb_stat", "kv_curr_items"))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.bucketErrors.WithLabelValues("beer-sample")))
+	require.Equal(t, float64(0), testutil.ToFloat64(m.bucketErrors.WithLabelValues("travel-sample")))
+	require.Equal(t, 0, testutil.CollectAndCount(m, flags...))
+
+	// The stat that isn't a number is returned as the only error of the collection.
+	m = newCollector(0, 0)
+	var collectionErr *common.CollectionError
+	require.ErrorAs(t, m.CollectContext(context.Background(), make(chan prometheus.Metric, 100)), &collectionErr)
+	require.Len(t, collectionErr.Errors, 1)
+
+	m = newCollector(5, 0)
+	require.Equal(t, 10, testutil.CollectAndCount(m, "kv_vb_stat", "kv_curr_items"))
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP cmos_exporter_kv_bucket_series_limit_reached Whether collection of the bucket's KV stats stopped at the per-bucket or overall series limit
+# TYPE cmos_exporter_kv_bucket_series_limit_reached gauge
+cmos_exporter_kv_bucket_series_limit_reached{bucket="beer-sample"} 1
+cmos_exporter_kv_bucket_series_limit_reached{bucket="travel-sample"} 1
+`), flags...))
+
+	// The first bucket uses up the overall limit, and the second isn't collected.
+	m = newCollector(0, 8)
+	require.Equal(t, 8, testutil.CollectAndCount(m, "kv_vb_stat", "kv_curr_items"))
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP cmos_exporter_kv_bucket_series_limit_reached Whether collection of the bucket's KV stats stopped at the per-bucket or overall series limit
+# TYPE cmos_exporter_kv_bucket_series_limit_reached gauge
+cmos_exporter_kv_bucket_series_limit_reached{bucket="beer-sample"} 1
+cmos_exporter_kv_bucket_series_limit_reached{bucket="travel-sample"} 1
+# HELP cmos_exporter_kv_series_limit_reached Whether collection of KV stats stopped at the overall series limit
+# TYPE cmos_exporter_kv_series_limit_reached gauge
+cmos_exporter_kv_series_limit_reached 1
+`), flags...))
+}
+
+// TestLimitsStable checks that the series limits keep the same series on every scrape, so that the series that are
+// dropped don't flap.
+func TestLimitsStable(t *testing.T) {
+	cluster := limitsCluster(t)
+	m, err := NewMemcachedMetrics(zap.NewNop(), cluster.Node, MetricSet{Stats: map[string]MetricConfigs{
+		"kv_vb_stat": {Values: []MetricConfig{
+			{Pattern: "^vb_(?P<stat>.+)$", Labels: []string{"bucket", "stat"}, Type: common.MetricGauge},
+		}},
+		"kv_ep_stat": {Values: []MetricConfig{
+			{Pattern: "^ep_(?P<stat>.+)$", Labels: []string{"bucket", "stat"}, Type: common.MetricGauge},
+		}},
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = m.Close() })
+	m.BucketSeriesLimit = 7
+	m.SeriesLimit = 10
+
+	first := scrapeSeries(t, m)
+	require.Len(t, first, 10)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, first, scrapeSeries(t, m))
+	}
+}
+
+// scrapeSeries returns the kv_ series that a scrape of m gives, as `name{label="value",...}`.
+func scrapeSeries(t *testing.T, m *Metrics) []string {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	var result []string
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "kv_") {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels = append(labels, pair.GetName()+"="+strconv.Quote(pair.GetValue()))
+			}
+			result = append(result, mf.GetName()+"{"+strings.Join(labels, ",")+"}")
+		}
+	}
+	return result
+}
@@ -21,8 +21,9 @@ import (
 	"sort"
 
 	"github.com/couchbase/gomemcached"
-	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 // Values are [upper bound, ops, percentile]
@@ -34,7 +35,7 @@ type commandTimingsResponse struct {
 	Total      float64        `json:"total"`
 }
 
-func (m *Metrics) processCommandTimings(metrics chan<- prometheus.Metric, bucket string) error {
+func (m *Metrics) processCommandTimings(emit common.Emitter, bucket string) error {
 	for _, opcode := range m.commandTimings.Opcodes {
 		m.logger.Debug("Requesting command timings", zap.String("key", bucket), zap.String("opcode", opcode.name))
 		res, err := m.mc.Send(&gomemcached.MCRequest{
@@ -47,6 +48,7 @@ func (m *Metrics) processCommandTimings(metrics chan<- prometheus.Metric, bucket
 		if err != nil {
 			return fmt.Errorf("failed to get command timings for opcode %s: %w", opcode.name, err)
 		}
+		m.RecordTimings(bucket, opcode.name, res.Body)
 		var data commandTimingsResponse
 		if err := json.Unmarshal(res.Body, &data); err != nil {
 			return fmt.Errorf("failed to unmarshal command timings for opcode %s: %w", opcode.name, err)
@@ -79,7 +81,7 @@ func (m *Metrics) processCommandTimings(metrics chan<- prometheus.Metric, bucket
 		if m.commandTimings.ResampleBuckets != nil {
 			histo.resample(m.commandTimings.ResampleBuckets)
 		}
-		metrics <- histo.metric()
+		histo.emit(emit)
 	}
 	return nil
 }
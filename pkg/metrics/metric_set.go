@@ -19,12 +19,16 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 
 	"github.com/creasty/defaults"
 
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/eventing"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/fts"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/gsi"
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/jsonapi"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/memcached"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/n1ql"
 	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/system"
@@ -39,6 +43,7 @@ type MetricSet struct {
 	FTS       fts.MetricSet       `json:"fts"`
 	Eventing  eventing.MetricSet  `json:"eventing"`
 	XDCR      xdcr.MetricSet      `json:"xdcr"`
+	JSONAPI   jsonapi.MetricSet   `json:"jsonapi"`
 }
 
 //go:embed defaultMetricSet.json
@@ -52,12 +57,100 @@ func LoadDefaultMetricSet() *MetricSet {
 	return ms
 }
 
+// LoadMetricSet loads a metric set from the given file, in the same format as the default one.
+func LoadMetricSet(path string) (*MetricSet, error) {
+	val, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metric set: %w", err)
+	}
+	return ParseMetricSet(val)
+}
+
 func ParseMetricSet(val []byte) (*MetricSet, error) {
 	var ms MetricSet
 	err := json.Unmarshal(val, &ms)
 	if err != nil {
 		return nil, err
 	}
-	err = defaults.Set(&ms)
-	return &ms, err
+	if err = defaults.Set(&ms); err != nil {
+		return nil, err
+	}
+	return &ms, ms.Validate()
+}
+
+// Validate checks the metric set of every collector, and that collectors don't define the same metric with different
+// labels. It returns a common.ValidationErrors of every problem found.
+func (m *MetricSet) Validate() error {
+	sections := []struct {
+		name string
+		ms   interface {
+			common.MetricSet
+			common.Definer
+		}
+	}{
+		{"memcached", m.Memcached},
+		{"gsi", m.GSI},
+		{"n1ql", m.N1QL},
+		{"system", m.System},
+		{"fts", m.FTS},
+		{"eventing", m.Eventing},
+		{"xdcr", m.XDCR},
+		{"jsonapi", m.JSONAPI},
+	}
+	var errs common.ValidationErrors
+	defined := make(map[string][]common.Definition)
+	for _, section := range sections {
+		path := common.JSONPath("", section.name)
+		if err := section.ms.Validate(); err != nil {
+			errs.Nest(path, err)
+		}
+		for _, def := range section.ms.Definitions() {
+			def.Path = path + def.Path
+			defined[def.Name] = append(defined[def.Name], def)
+		}
+	}
+	for _, defs := range defined {
+		sort.Slice(defs, func(i, j int) bool {
+			return defs[i].Path < defs[j].Path
+		})
+		// Collectors with the same labels can share a metric, but Prometheus rejects metrics with different labels.
+		// Where a collector's options choose the labels, they may differ.
+		first := defs[0]
+		for _, def := range defs[1:] {
+			switch {
+			case def.Labels == nil || first.Labels == nil:
+				errs.Addf(def.Path, "metric %s is also defined by %s", def.Name, first.Path)
+			case !equalLabels(def.Labels, first.Labels):
+				errs.Addf(def.Path, "metric %s has labels %v, but %s has %v", def.Name, def.Labels, first.Path,
+					first.Labels)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// Filter returns a copy of m with only the metrics that allowed returns true for, by their Prometheus names.
+func (m *MetricSet) Filter(allowed func(name string) bool) *MetricSet {
+	return &MetricSet{
+		Memcached: m.Memcached.Filter(allowed),
+		GSI:       m.GSI.Filter(allowed),
+		N1QL:      m.N1QL.Filter(allowed),
+		System:    m.System.Filter(allowed),
+		FTS:       m.FTS.Filter(allowed),
+		Eventing:  m.Eventing.Filter(allowed),
+		XDCR:      m.XDCR.Filter(allowed),
+		JSONAPI:   m.JSONAPI.Filter(allowed),
+	}
+}
+
+func equalLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
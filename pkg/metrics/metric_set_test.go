@@ -0,0 +1,76 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+func TestDefaultMetricSetValid(t *testing.T) {
+	_, err := ParseMetricSet(defaultMetricSet)
+	require.NoError(t, err)
+}
+
+func TestMetricSetValidate(t *testing.T) {
+	_, err := ParseMetricSet([]byte(`{
+		"gsi": {"index_items_count": {"name": "items_count", "type": "bogus"}},
+		"fts": {"index_items_count": {"name": "num_docs"}},
+		"eventing": {
+			"eventing_x": {"expression": "[.a, .b]", "labels": ["functionName"]}
+		},
+		"jsonapi": {
+			"x": {"service": "eventing", "endpoint": "/x", "metrics": {
+				"eventing_x": {"expression": "[.a, .b, .c]", "labels": ["functionName", "other"]}
+			}}
+		}
+	}`))
+	var errs common.ValidationErrors
+	require.ErrorAs(t, err, &errs)
+	require.Equal(t, common.ValidationErrors{
+		{Path: ".gsi.index_items_count", Err: errs[0].Err},
+		{Path: ".gsi.index_items_count.type", Err: errs[1].Err},
+		{Path: ".jsonapi.x.metrics.eventing_x", Err: errs[2].Err},
+	}, errs)
+	require.Contains(t, errs[0].Error(), "also defined by .fts.index_items_count")
+	require.Contains(t, errs[1].Error(), `unknown metric type "bogus"`)
+	require.Contains(t, errs[2].Error(), "has labels [functionName other], but .eventing.eventing_x has [functionName]")
+}
+
+func TestMetricSetFilter(t *testing.T) {
+	ms := LoadDefaultMetricSet()
+	filter, err := common.NewFilter([]string{"kv_.*", "sys_.*"}, []string{"kv_cmd_duration_seconds"})
+	require.NoError(t, err)
+	filtered := ms.Filter(filter.Allowed)
+	require.NoError(t, filtered.Validate())
+
+	require.NotEmpty(t, filtered.Memcached.Stats)
+	require.Nil(t, filtered.Memcached.CommandTimings)
+	require.NotNil(t, ms.Memcached.CommandTimings, "the original metric set shouldn't change")
+	require.NotEmpty(t, filtered.System)
+	for _, metric := range filtered.System {
+		require.Regexp(t, "^sys_", metric.Name)
+	}
+	require.Empty(t, filtered.GSI)
+	require.Empty(t, filtered.N1QL)
+	require.Empty(t, filtered.FTS)
+	require.Empty(t, filtered.Eventing)
+	require.Empty(t, filtered.XDCR)
+	require.Empty(t, filtered.JSONAPI)
+}
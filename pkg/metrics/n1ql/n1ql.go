@@ -17,9 +17,8 @@ package n1ql
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,36 +31,184 @@ import (
 )
 
 type Metric struct {
+	// Name is the stat to use. Nested stats are named by their dot-separated path, e.g. `request_timer.mean`.
 	Name string            `json:"name"`
 	Help string            `json:"help"`
 	Type common.MetricType `json:"type"`
+	// Count and Quantiles are only used for summaries: Name is the stat holding the sum of the observations, Count the
+	// stat holding their count, and Quantiles maps each quantile (e.g. `0.95`) to the stat holding its value.
+	Count     string            `json:"count"`
+	Quantiles map[string]string `json:"quantiles"`
+	// Source is where the query service exposes this stat:
+	//   - `stats` (the default) is the flat `/admin/stats` endpoint;
+	//   - `vitals` is `/admin/vitals`, where durations (such as `gc.pause.time`) are converted to seconds;
+	//   - `active_requests` and `completed_requests` summarise `system:active_requests` and
+	//     `system:completed_requests` (via `/admin/active_requests` and `/admin/completed_requests`), where Name is
+	//     one of `count` (labelled by request state), `max_elapsed` (in seconds), or `over_threshold`.
+	//   - `prepareds` is the prepared statement cache (`/admin/prepareds`), with a series for each statement labelled
+	//     by its name and a hash of its text, where Name is one of `uses`, `avg_service_time` (in seconds), or
+	//     `last_use` (as a Unix timestamp). Only the most used statements are included, see NewMetrics.
+	// Each endpoint is only queried if at least one metric uses it.
+	Source string `json:"source"`
+	// Threshold is the elapsed time (e.g. `5s`) over which a request is counted by an `over_threshold` metric.
+	Threshold string `json:"threshold"`
 }
 
+const (
+	SourceStats             = "stats"
+	SourceVitals            = "vitals"
+	SourceActiveRequests    = "active_requests"
+	SourceCompletedRequests = "completed_requests"
+	SourcePrepareds         = "prepareds"
+)
+
+// Summaries of the active and completed requests.
+const (
+	RequestsCount         = "count"
+	RequestsMaxElapsed    = "max_elapsed"
+	RequestsOverThreshold = "over_threshold"
+)
+
+// Fields of the prepared statements.
+const (
+	PreparedUses           = "uses"
+	PreparedAvgServiceTime = "avg_service_time"
+	PreparedLastUse        = "last_use"
+)
+
 type MetricSet map[string]Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(path, err)
+		}
+		if err := metric.Type.Validate(common.MetricSummary); err != nil {
+			errs.Add(path+".type", err)
+		}
+		if metric.Type == common.MetricSummary {
+			if metric.Source != "" && metric.Source != SourceStats {
+				errs.Addf(path+".source", "summaries are only supported for stats")
+			}
+			if metric.Count == "" {
+				errs.Addf(path+".count", "summaries need a count")
+			}
+			if _, err := parseQuantiles(metric.Quantiles); err != nil {
+				errs.Add(path+".quantiles", err)
+			}
+		} else if metric.Count != "" || len(metric.Quantiles) > 0 {
+			errs.Addf(path, "count and quantiles are only valid for summaries")
+		}
+		switch metric.Source {
+		case "", SourceStats, SourceVitals:
+		case SourceActiveRequests, SourceCompletedRequests:
+			switch metric.Name {
+			case RequestsCount, RequestsMaxElapsed:
+			case RequestsOverThreshold:
+				if metric.Threshold == "" {
+					errs.Addf(path+".threshold", "over_threshold needs a threshold")
+				}
+			default:
+				errs.Addf(path+".name", "unknown %s summary %q", metric.Source, metric.Name)
+			}
+		case SourcePrepareds:
+			switch metric.Name {
+			case PreparedUses, PreparedAvgServiceTime, PreparedLastUse:
+			default:
+				errs.Addf(path+".name", "unknown prepared statement field %q", metric.Name)
+			}
+		default:
+			errs.Addf(path+".source", "unknown source %q", metric.Source)
+		}
+		if metric.Threshold != "" {
+			if metric.Name != RequestsOverThreshold {
+				errs.Addf(path+".threshold", "threshold is only valid for over_threshold")
+			}
+			if _, err := time.ParseDuration(metric.Threshold); err != nil {
+				errs.Addf(path+".threshold", "invalid threshold: %w", err)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key, metric := range ms {
+		defs = append(defs, common.Definition{
+			Path:   common.JSONPath("", key),
+			Name:   key,
+			Labels: common.DefinitionLabels(metricLabels(metric), nil),
+		})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if allowed(key) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
+// metricLabels returns the names of the labels of metric, which depend on its source.
+func metricLabels(metric Metric) []string {
+	source := metric.Source
+	if source == "" {
+		source = SourceStats
+	}
+	switch source {
+	case SourceActiveRequests, SourceCompletedRequests:
+		if metric.Name == RequestsCount {
+			return []string{"state"}
+		}
+	case SourcePrepareds:
+		return []string{"name", "statement_hash"}
+	}
+	return nil
+}
+
 type metricInternal struct {
 	n1qlName   string
 	desc       *prometheus.Desc
 	metricType common.MetricType
+	source     string
+	threshold  time.Duration
+	// countName and quantiles are only set for summaries, see Metric
+	countName string
+	quantiles map[float64]string
 }
 
-// Note: this is keyed by n1ql name, NOT prometheus name
+// Note: this is keyed by prometheus name, as the same n1ql name can appear in more than one source
 type metricSetInternal map[string]*metricInternal
 
+// DefaultPreparedsLimit is the default limit on the number of prepared statements, see NewMetrics.
+const DefaultPreparedsLimit = 100
+
 type Metrics struct {
-	ms MetricSet
-	// Note: this is keyed by n1ql name, NOT prometheus name
-	msi    metricSetInternal
-	node   couchbase.NodeCommon
-	mux    sync.Mutex
-	logger *zap.Logger
+	common.Base
+	msi            metricSetInternal
+	mux            sync.Mutex
+	preparedsLimit int
+	// sources is the set of sources used by at least one metric.
+	sources map[string]bool
 }
 
-func NewMetrics(logger *zap.SugaredLogger, node couchbase.NodeCommon, ms MetricSet) (*Metrics, error) {
+// NewMetrics creates the N1QL collector. preparedsLimit is the maximum number of prepared statements to emit metrics
+// for, to bound the cardinality of the prepared statement metrics - the most used statements are kept. Zero or less
+// means no limit.
+func NewMetrics(logger *zap.SugaredLogger, node couchbase.NodeCommon, ms MetricSet, preparedsLimit int,
+) (*Metrics, error) {
 	ret := &Metrics{
-		node:   node,
-		msi:    make(metricSetInternal),
-		logger: logger.Desugar(),
+		Base:           common.NewBase("n1ql", logger, node),
+		msi:            make(metricSetInternal),
+		preparedsLimit: preparedsLimit,
 	}
 	ret.updateMetricSet(ms)
 	return ret, nil
@@ -74,48 +221,106 @@ func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
 }
 
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		end := time.Now()
-		m.logger.Info("Completed N1QL collection", zap.Duration("elapsed", end.Sub(start)))
-	}()
-	m.logger.Info("Starting N1QL collection")
+	_ = m.CollectContext(context.Background(), metrics)
+}
+
+func (m *Metrics) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer m.StartCollection()()
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	res, err := m.node.RestClient().Do(context.TODO(), &cbrest.Request{
-		Method:             "GET",
-		Endpoint:           "/admin/stats",
-		Service:            cbrest.ServiceQuery,
-		ExpectedStatusCode: http.StatusOK,
-	})
-	if err != nil {
-		m.logger.Sugar().Errorw("Failed to get N1QL stats", "err", err)
+
+	emit := m.Emitter(metrics)
+	if m.sources[SourceStats] {
+		m.collectStats(ctx, emit)
+	}
+	if m.sources[SourceVitals] {
+		m.collectVitals(ctx, emit)
+	}
+	if m.sources[SourceActiveRequests] {
+		m.collectRequests(ctx, emit, SourceActiveRequests, "/admin/active_requests")
+	}
+	if m.sources[SourceCompletedRequests] {
+		m.collectRequests(ctx, emit, SourceCompletedRequests, "/admin/completed_requests")
+	}
+	if m.sources[SourcePrepareds] {
+		m.collectPrepareds(ctx, emit)
+	}
+	m.Logger.Debug("N1QL collection complete")
+	return emit.Err()
+}
+
+func (m *Metrics) collectStats(ctx context.Context, emit common.Emitter) {
+	var raw map[string]interface{}
+	if err := m.fetch(ctx, "/admin/stats", &raw); err != nil {
+		m.Logger.Errorw("Failed to get N1QL stats", "err", err)
+		emit.Error(err)
 		return
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		m.logger.Sugar().Errorw("Failed to read N1QL stats", "err", err)
+	result := make(map[string]interface{}, len(raw))
+	common.FlattenStats("", raw, result)
+
+	for _, metric := range m.msi {
+		if metric.source != SourceStats {
+			continue
+		}
+		if metric.metricType == common.MetricSummary {
+			m.collectSummary(emit, metric, result)
+			continue
+		}
+		value, ok := result[metric.n1qlName].(float64)
+		if ok {
+			emit.TypedMetric(metric.desc, metric.metricType, value)
+		}
+	}
+}
+
+// collectSummary emits a summary from separate sum, count, and quantile stats, such as the request time counter and
+// the percentiles of the request timer. Quantiles missing from the stats are left out.
+func (m *Metrics) collectSummary(emit common.Emitter, metric *metricInternal,
+	result map[string]interface{},
+) {
+	sum, ok := result[metric.n1qlName].(float64)
+	if !ok {
 		return
 	}
-	type n1qlResult map[string]float64
-	var result n1qlResult
-	if err := json.Unmarshal(body, &result); err != nil {
-		m.logger.Sugar().Errorw("Failed to parse N1QL stats", "err", err)
+	count, ok := result[metric.countName].(float64)
+	if !ok {
 		return
 	}
+	quantiles := make(map[float64]float64, len(metric.quantiles))
+	for quantile, stat := range metric.quantiles {
+		if value, ok := result[stat].(float64); ok {
+			quantiles[quantile] = value
+		}
+	}
+	emit.Summary(metric.desc, uint64(count), sum, quantiles)
+}
 
-	for stat, value := range result {
-		metric, ok := m.msi[stat]
-		if ok {
-			metrics <- prometheus.MustNewConstMetric(
-				metric.desc,
-				metric.metricType.ToPrometheus(),
-				value,
-			)
+// parseQuantiles parses the quantiles of a summary from their string keys.
+func parseQuantiles(quantiles map[string]string) (map[float64]string, error) {
+	result := make(map[float64]string, len(quantiles))
+	for key, stat := range quantiles {
+		quantile, err := strconv.ParseFloat(key, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			return nil, fmt.Errorf("invalid quantile %q", key)
 		}
+		result[quantile] = stat
 	}
-	m.logger.Debug("N1QL collection complete")
+	return result, nil
+}
+
+func (m *Metrics) fetch(ctx context.Context, endpoint string, result interface{}) error {
+	return m.Fetch(ctx, cbrest.ServiceQuery, endpoint, result)
+}
+
+// Update replaces the metric set, which must be an n1ql.MetricSet.
+func (m *Metrics) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(m.Name(), ms)
+	}
+	m.updateMetricSet(metrics)
+	return nil
 }
 
 func (m *Metrics) updateMetricSet(ms MetricSet) {
@@ -123,14 +328,28 @@ func (m *Metrics) updateMetricSet(ms MetricSet) {
 	defer m.mux.Unlock()
 
 	msi := make(metricSetInternal)
+	sources := make(map[string]bool)
 	for promName, metric := range ms {
-		msi[metric.Name] = &metricInternal{
+		source := metric.Source
+		if source == "" {
+			source = SourceStats
+		}
+		labels := metricLabels(metric)
+		// Already checked by Validate
+		threshold, _ := time.ParseDuration(metric.Threshold)
+		quantiles, _ := parseQuantiles(metric.Quantiles)
+		msi[promName] = &metricInternal{
 			n1qlName:   metric.Name,
-			desc:       prometheus.NewDesc(promName, metric.Help, nil, nil),
-			metricType: metric.Type,
+			desc:       prometheus.NewDesc(promName, common.ResolveHelp(promName, metric.Help), labels, nil),
+			metricType: common.ResolveType(promName, metric.Type),
+			source:     source,
+			threshold:  threshold,
+			countName:  metric.Count,
+			quantiles:  quantiles,
 		}
+		sources[source] = true
 	}
 
-	m.ms = ms
 	m.msi = msi
+	m.sources = sources
 }
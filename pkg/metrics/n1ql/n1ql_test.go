@@ -0,0 +1,68 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+func TestCollectSummary(t *testing.T) {
+	quantiles, err := parseQuantiles(map[string]string{
+		"0.5":  "request_timer.median",
+		"0.99": "request_timer.99%",
+	})
+	require.NoError(t, err)
+	metric := &metricInternal{
+		n1qlName:   "request_time.count",
+		desc:       prometheus.NewDesc("n1ql_request_timer", "", nil, nil),
+		metricType: common.MetricSummary,
+		countName:  "requests.count",
+		quantiles:  quantiles,
+	}
+	raw := map[string]interface{}{
+		"request_time.count": float64(5000),
+		"requests.count":     float64(10),
+		"request_timer": map[string]interface{}{
+			"median": float64(400),
+		},
+	}
+	result := make(map[string]interface{})
+	common.FlattenStats("", raw, result)
+
+	metrics := make(chan prometheus.Metric, 1)
+	(&Metrics{}).collectSummary(common.NewEmitter("n1ql", metrics), metric, result)
+	require.Len(t, metrics, 1)
+	var out dto.Metric
+	require.NoError(t, (<-metrics).Write(&out))
+	require.Equal(t, uint64(10), out.GetSummary().GetSampleCount())
+	require.Equal(t, float64(5000), out.GetSummary().GetSampleSum())
+	require.Len(t, out.GetSummary().GetQuantile(), 1)
+	require.Equal(t, 0.5, out.GetSummary().GetQuantile()[0].GetQuantile())
+	require.Equal(t, float64(400), out.GetSummary().GetQuantile()[0].GetValue())
+}
+
+func TestParseQuantilesInvalid(t *testing.T) {
+	_, err := parseQuantiles(map[string]string{"1.5": "request_timer.max"})
+	require.Error(t, err)
+	_, err = parseQuantiles(map[string]string{"p99": "request_timer.99%"})
+	require.Error(t, err)
+}
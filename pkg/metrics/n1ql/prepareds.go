@@ -0,0 +1,104 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// prepared is an entry in `/admin/prepareds`. We only need the fields we expose.
+type prepared struct {
+	Name           string `json:"name"`
+	Statement      string `json:"statement"`
+	Uses           int64  `json:"uses"`
+	AvgServiceTime string `json:"avgServiceTime"`
+	LastUse        string `json:"lastUse"`
+}
+
+// lastUseLayout is the layout of `lastUse`, which the query service formats with time.Time.String().
+const lastUseLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// parseLastUse parses the last use time of a prepared statement, ignoring any monotonic clock reading.
+func parseLastUse(val string) (time.Time, error) {
+	if idx := strings.Index(val, " m="); idx >= 0 {
+		val = val[:idx]
+	}
+	return time.Parse(lastUseLayout, val)
+}
+
+// statementHash is a short hash of a statement's text, so that statements can be told apart without using their
+// (potentially very long) text as a label.
+func statementHash(statement string) string {
+	sum := sha256.Sum256([]byte(statement))
+	return hex.EncodeToString(sum[:8])
+}
+
+// topPrepareds returns the limit most used prepared statements, or all of them if limit is zero or less.
+func topPrepareds(prepareds []prepared, limit int) []prepared {
+	sort.SliceStable(prepareds, func(i, j int) bool {
+		return prepareds[i].Uses > prepareds[j].Uses
+	})
+	if limit > 0 && len(prepareds) > limit {
+		prepareds = prepareds[:limit]
+	}
+	return prepareds
+}
+
+func (m *Metrics) collectPrepareds(ctx context.Context, emit common.Emitter) {
+	var result []prepared
+	if err := m.fetch(ctx, "/admin/prepareds", &result); err != nil {
+		m.Logger.Errorw("Failed to get N1QL prepared statements", "err", err)
+		emit.Error(err)
+		return
+	}
+	if m.preparedsLimit > 0 && len(result) > m.preparedsLimit {
+		m.Logger.Debugw("Limiting prepared statement metrics", "prepareds", len(result),
+			"limit", m.preparedsLimit)
+	}
+	for _, stmt := range topPrepareds(result, m.preparedsLimit) {
+		hash := statementHash(stmt.Statement)
+		for _, metric := range m.msi {
+			if metric.source != SourcePrepareds {
+				continue
+			}
+			var value float64
+			switch metric.n1qlName {
+			case PreparedUses:
+				value = float64(stmt.Uses)
+			case PreparedAvgServiceTime:
+				dur, err := time.ParseDuration(stmt.AvgServiceTime)
+				if err != nil {
+					continue
+				}
+				value = dur.Seconds()
+			case PreparedLastUse:
+				lastUse, err := parseLastUse(stmt.LastUse)
+				if err != nil {
+					continue
+				}
+				value = float64(lastUse.UnixNano()) / float64(time.Second)
+			}
+			emit.TypedMetric(metric.desc, metric.metricType, value, stmt.Name, hash)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopPrepareds(t *testing.T) {
+	prepareds := []prepared{
+		{Name: "a", Uses: 1},
+		{Name: "b", Uses: 10},
+		{Name: "c", Uses: 5},
+	}
+	top := topPrepareds(prepareds, 2)
+	require.Len(t, top, 2)
+	require.Equal(t, "b", top[0].Name)
+	require.Equal(t, "c", top[1].Name)
+
+	require.Len(t, topPrepareds(prepareds, 0), 3)
+}
+
+func TestParseLastUse(t *testing.T) {
+	expected := time.Date(2022, 11, 8, 11, 12, 32, 918000000, time.UTC)
+	for _, val := range []string{
+		"2022-11-08 11:12:32.918 +0000 UTC",
+		"2022-11-08 11:12:32.918 +0000 UTC m=+3600.123456789",
+	} {
+		lastUse, err := parseLastUse(val)
+		require.NoError(t, err, val)
+		require.True(t, expected.Equal(lastUse), val)
+	}
+}
+
+func TestStatementHash(t *testing.T) {
+	require.Len(t, statementHash("SELECT 1"), 16)
+	require.Equal(t, statementHash("SELECT 1"), statementHash("SELECT 1"))
+	require.NotEqual(t, statementHash("SELECT 1"), statementHash("SELECT 2"))
+}
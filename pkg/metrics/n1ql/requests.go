@@ -0,0 +1,92 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+// request is an entry in `/admin/active_requests` or `/admin/completed_requests`. We only need the fields we summarise.
+type request struct {
+	State       string `json:"state"`
+	ElapsedTime string `json:"elapsedTime"`
+}
+
+// requestsSummary is the state counts and elapsed times of a list of requests.
+type requestsSummary struct {
+	states  map[string]int
+	elapsed []time.Duration
+}
+
+func summariseRequests(requests []request) requestsSummary {
+	result := requestsSummary{
+		states:  make(map[string]int),
+		elapsed: make([]time.Duration, 0, len(requests)),
+	}
+	for _, req := range requests {
+		result.states[req.State]++
+		if elapsed, err := time.ParseDuration(req.ElapsedTime); err == nil {
+			result.elapsed = append(result.elapsed, elapsed)
+		}
+	}
+	sort.Slice(result.elapsed, func(i, j int) bool {
+		return result.elapsed[i] > result.elapsed[j]
+	})
+	return result
+}
+
+func (s requestsSummary) maxElapsed() time.Duration {
+	if len(s.elapsed) == 0 {
+		return 0
+	}
+	return s.elapsed[0]
+}
+
+func (s requestsSummary) overThreshold(threshold time.Duration) int {
+	// elapsed is sorted slowest first
+	return sort.Search(len(s.elapsed), func(i int) bool {
+		return s.elapsed[i] <= threshold
+	})
+}
+
+func (m *Metrics) collectRequests(ctx context.Context, emit common.Emitter, source, endpoint string) {
+	var result []request
+	if err := m.fetch(ctx, endpoint, &result); err != nil {
+		m.Logger.Errorw("Failed to get N1QL requests", "endpoint", endpoint, "err", err)
+		emit.Error(err)
+		return
+	}
+	summary := summariseRequests(result)
+	for _, metric := range m.msi {
+		if metric.source != source {
+			continue
+		}
+		switch metric.n1qlName {
+		case RequestsCount:
+			for state, count := range summary.states {
+				emit.TypedMetric(metric.desc, metric.metricType, float64(count), state)
+			}
+		case RequestsMaxElapsed:
+			emit.TypedMetric(metric.desc, metric.metricType, summary.maxElapsed().Seconds())
+		case RequestsOverThreshold:
+			emit.TypedMetric(metric.desc, metric.metricType, float64(summary.overThreshold(metric.threshold)))
+		}
+	}
+}
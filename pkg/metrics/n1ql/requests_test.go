@@ -0,0 +1,54 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummariseRequests(t *testing.T) {
+	summary := summariseRequests([]request{
+		{State: "running", ElapsedTime: "1.5s"},
+		{State: "running", ElapsedTime: "250ms"},
+		{State: "submitted", ElapsedTime: "12.3µs"},
+		{State: "running", ElapsedTime: "6m0.5s"},
+		{State: "running", ElapsedTime: "bogus"},
+	})
+	require.Equal(t, map[string]int{"running": 4, "submitted": 1}, summary.states)
+	require.Equal(t, 6*time.Minute+500*time.Millisecond, summary.maxElapsed())
+	require.Equal(t, 2, summary.overThreshold(time.Second))
+	require.Equal(t, 1, summary.overThreshold(time.Minute))
+	require.Equal(t, 0, summary.overThreshold(time.Hour))
+	require.Equal(t, 4, summary.overThreshold(0))
+
+	require.Equal(t, time.Duration(0), summariseRequests(nil).maxElapsed())
+}
+
+func TestVitalValue(t *testing.T) {
+	value, ok := vitalValue(float64(42))
+	require.True(t, ok)
+	require.Equal(t, float64(42), value)
+
+	value, ok = vitalValue("1m30s")
+	require.True(t, ok)
+	require.Equal(t, float64(90), value)
+
+	_, ok = vitalValue("not a duration")
+	require.False(t, ok)
+}
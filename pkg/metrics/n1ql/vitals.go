@@ -0,0 +1,64 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package n1ql
+
+import (
+	"context"
+	"time"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
+)
+
+func (m *Metrics) collectVitals(ctx context.Context, emit common.Emitter) {
+	var result map[string]interface{}
+	if err := m.fetch(ctx, "/admin/vitals", &result); err != nil {
+		m.Logger.Errorw("Failed to get N1QL vitals", "err", err)
+		emit.Error(err)
+		return
+	}
+	for _, metric := range m.msi {
+		if metric.source != SourceVitals {
+			continue
+		}
+		raw, ok := result[metric.n1qlName]
+		if !ok {
+			continue
+		}
+		value, ok := vitalValue(raw)
+		if !ok {
+			m.Logger.Debugw("Unhandled N1QL vital value", "vital", metric.n1qlName, "value", raw)
+			continue
+		}
+		emit.TypedMetric(metric.desc, metric.metricType, value)
+	}
+}
+
+// vitalValue converts a value from `/admin/vitals` to a float. Most are numbers, but times (such as `uptime` and the
+// request time percentiles) are Go duration strings, which are converted to seconds.
+func vitalValue(raw interface{}) (float64, bool) {
+	switch val := raw.(type) {
+	case float64:
+		return val, true
+	case string:
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return 0, false
+		}
+		return dur.Seconds(), true
+	default:
+		return 0, false
+	}
+}
@@ -18,11 +18,14 @@ package system
 import (
 	"context"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/gosigar"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/metrics/common"
 )
 
 type MetricName string
@@ -50,8 +53,10 @@ var metricLabels = map[MetricName][]string{
 type Metric struct {
 	Name        string            `json:"name"`
 	Help        string            `json:"help"`
+	Type        common.MetricType `json:"type"`
 	ConstLabels prometheus.Labels `json:"constLabels"`
 	desc        *prometheus.Desc
+	typ         common.MetricType
 }
 
 // MetricSet is the metrics used by the system collector.
@@ -59,10 +64,60 @@ type Metric struct {
 // NOTE: this works differently to the other collectors - the keys are well-known
 type MetricSet map[MetricName]*Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", string(key))
+		if metric == nil {
+			continue
+		}
+		// Metrics without a name aren't collected.
+		if metric.Name != "" {
+			if err := common.CheckMetricName(metric.Name); err != nil {
+				errs.Add(path+".name", err)
+			}
+		}
+		if err := metric.Type.Validate(); err != nil {
+			errs.Add(path+".type", err)
+		}
+		if err := common.CheckLabelNames(metricLabels[key], metric.ConstLabels); err != nil {
+			errs.Add(path+".constLabels", err)
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key, metric := range ms {
+		if metric == nil || metric.Name == "" {
+			continue
+		}
+		defs = append(defs, common.Definition{
+			Path:   common.JSONPath("", string(key), "name"),
+			Name:   metric.Name,
+			Labels: common.DefinitionLabels(metricLabels[key], metric.ConstLabels),
+		})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if metric != nil && metric.Name != "" && allowed(metric.Name) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
 type Collector struct {
-	logger *zap.SugaredLogger
-	sigar  *sigar.ConcreteSigar
-	ms     MetricSet
+	common.Base
+	sigar *sigar.ConcreteSigar
+	ms    MetricSet
+	msMux sync.RWMutex
 
 	latestCPUStats sigar.Cpu
 	ctx            context.Context //nolint:containedctx
@@ -77,16 +132,31 @@ func (c *Collector) Close() error {
 
 func NewSystemMetrics(logger *zap.SugaredLogger, ms MetricSet) *Collector {
 	c := &Collector{
-		logger: logger,
-		ms:     ms,
-		sigar:  new(sigar.ConcreteSigar),
+		Base:  common.NewBase("system", logger, nil),
+		ms:    ms,
+		sigar: new(sigar.ConcreteSigar),
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
 	go c.pumpCPU()
 	return c
 }
 
+// Update replaces the metric set, which must be a system.MetricSet.
+func (c *Collector) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(c.Name(), ms)
+	}
+	c.msMux.Lock()
+	defer c.msMux.Unlock()
+	c.ms = metrics
+	c.prepareMetrics()
+	return nil
+}
+
 func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
+	c.msMux.Lock()
+	defer c.msMux.Unlock()
 	c.prepareMetrics()
 	for _, metric := range c.ms {
 		if metric.desc != nil {
@@ -96,33 +166,39 @@ func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
 }
 
 func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	c.logger.Info("Starting System collection")
-	defer func() {
-		c.logger.Infow("Completed System collection", "elapsed", time.Since(start))
-	}()
-	c.memMetrics(metrics)
-	c.cpuMetrics(metrics)
+	_ = c.CollectContext(context.Background(), metrics)
+}
+
+// CollectContext ignores ctx, as the system stats are gathered locally.
+func (c *Collector) CollectContext(_ context.Context, metrics chan<- prometheus.Metric) error {
+	defer c.StartCollection()()
+	c.msMux.RLock()
+	defer c.msMux.RUnlock()
+	emit := c.Emitter(metrics)
+	c.memMetrics(emit)
+	c.cpuMetrics(emit)
+	return emit.Err()
 }
 
-func (c *Collector) memMetrics(metrics chan<- prometheus.Metric) {
+func (c *Collector) memMetrics(emit common.Emitter) {
 	// Alas, for consistency with CB we need to ignore cgroups
 	mem, err := c.sigar.GetMemIgnoringCGroups()
 	if err != nil {
-		c.logger.Errorw("Failed to collect memory stats", "error", err)
+		c.Logger.Errorw("Failed to collect memory stats", "error", err)
+		emit.Error(err)
 		return
 	}
 	if m, ok := c.ms[MemFree]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(mem.Free))
+		emit.TypedMetric(m.desc, m.typ, float64(mem.Free))
 	}
 	if m, ok := c.ms[MemTotal]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(mem.Total))
+		emit.TypedMetric(m.desc, m.typ, float64(mem.Total))
 	}
 	if m, ok := c.ms[MemActualFree]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(mem.ActualFree))
+		emit.TypedMetric(m.desc, m.typ, float64(mem.ActualFree))
 	}
 	if m, ok := c.ms[MemActualUsed]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(mem.ActualUsed))
+		emit.TypedMetric(m.desc, m.typ, float64(mem.ActualUsed))
 	}
 }
 
@@ -132,32 +208,34 @@ func (c *Collector) prepareMetrics() {
 			continue
 		}
 		if metric.desc == nil {
-			c.ms[key].desc = prometheus.NewDesc(metric.Name, metric.Help, metricLabels[key], metric.ConstLabels)
+			c.ms[key].desc = prometheus.NewDesc(metric.Name, common.ResolveHelp(metric.Name, metric.Help), metricLabels[key],
+				metric.ConstLabels)
+			c.ms[key].typ = common.ResolveType(metric.Name, metric.Type)
 		}
 	}
 }
 
-func (c *Collector) cpuMetrics(metrics chan<- prometheus.Metric) {
+func (c *Collector) cpuMetrics(emit common.Emitter) {
 	if c.latestCPUStats.Total() == 0 {
 		return
 	}
 	if m, ok := c.ms[cpuUtilization]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, (1-float64(c.latestCPUStats.Idle)/float64(c.latestCPUStats.Total()))*100)
+		emit.TypedMetric(m.desc, m.typ, (1-float64(c.latestCPUStats.Idle)/float64(c.latestCPUStats.Total()))*100)
 	}
 	if m, ok := c.ms[cpuUser]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(c.latestCPUStats.User)/float64(c.latestCPUStats.Total())*100)
+		emit.TypedMetric(m.desc, m.typ, float64(c.latestCPUStats.User)/float64(c.latestCPUStats.Total())*100)
 	}
 	if m, ok := c.ms[cpuSys]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(c.latestCPUStats.Sys)/float64(c.latestCPUStats.Total())*100)
+		emit.TypedMetric(m.desc, m.typ, float64(c.latestCPUStats.Sys)/float64(c.latestCPUStats.Total())*100)
 	}
 	if m, ok := c.ms[cpuIrq]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(c.latestCPUStats.Irq)/float64(c.latestCPUStats.Total())*100)
+		emit.TypedMetric(m.desc, m.typ, float64(c.latestCPUStats.Irq)/float64(c.latestCPUStats.Total())*100)
 	}
 	if m, ok := c.ms[cpuStolen]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(c.latestCPUStats.Stolen)/float64(c.latestCPUStats.Total())*100)
+		emit.TypedMetric(m.desc, m.typ, float64(c.latestCPUStats.Stolen)/float64(c.latestCPUStats.Total())*100)
 	}
 	if m, ok := c.ms[cpuCoresAvailable]; ok {
-		metrics <- prometheus.MustNewConstMetric(m.desc, prometheus.UntypedValue, float64(runtime.NumCPU()))
+		emit.TypedMetric(m.desc, m.typ, float64(runtime.NumCPU()))
 	}
 }
 
@@ -1,6 +1,7 @@
 package xdcr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,7 +9,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
@@ -25,6 +25,43 @@ type Metric struct {
 
 type MetricSet map[string]Metric
 
+func (ms MetricSet) Validate() error {
+	var errs common.ValidationErrors
+	for key, metric := range ms {
+		path := common.JSONPath("", key)
+		if err := common.CheckMetricName(key); err != nil {
+			errs.Add(path, err)
+		}
+		if err := metric.Type.Validate(); err != nil {
+			errs.Add(path+".type", err)
+		}
+	}
+	return errs.Err()
+}
+
+func (ms MetricSet) Definitions() []common.Definition {
+	defs := make([]common.Definition, 0, len(ms))
+	for key := range ms {
+		defs = append(defs, common.Definition{
+			Path:   common.JSONPath("", key),
+			Name:   key,
+			Labels: common.DefinitionLabels(labelNames, nil),
+		})
+	}
+	return defs
+}
+
+// Filter returns a copy of ms with only the metrics that allowed returns true for.
+func (ms MetricSet) Filter(allowed func(name string) bool) MetricSet {
+	result := make(MetricSet, len(ms))
+	for key, metric := range ms {
+		if allowed(key) {
+			result[key] = metric
+		}
+	}
+	return result
+}
+
 type metricInternal struct {
 	Metric
 	desc *prometheus.Desc
@@ -32,23 +69,25 @@ type metricInternal struct {
 
 type metricSetInternal map[string]*metricInternal
 
-// TODO: don't hard-code this
-const xdcrRestPort = 9998
+// DefaultRESTPort is the port that XDCR's admin API listens on by default.
+const DefaultRESTPort = 9998
 
 type Metrics struct {
-	logger *zap.SugaredLogger
-	node   couchbase.NodeCommon
-	msi    metricSetInternal
-	mux    sync.RWMutex
+	// RESTPort is the port of XDCR's admin API on this node.
+	RESTPort int
+
+	common.Base
+	msi metricSetInternal
+	mux sync.RWMutex
 }
 
 var labelNames = []string{"targetClusterUUID", "sourceBucketName", "targetBucketName", "pipelineType"}
 
 func NewXDCRMetrics(logger *zap.SugaredLogger, node couchbase.NodeCommon, metricSet MetricSet) (*Metrics, error) {
 	coll := &Metrics{
-		logger: logger,
-		node:   node,
-		msi:    make(metricSetInternal),
+		RESTPort: DefaultRESTPort,
+		Base:     common.NewBase("xdcr", logger, node),
+		msi:      make(metricSetInternal),
 	}
 	coll.updateMSI(metricSet)
 	return coll, nil
@@ -62,60 +101,77 @@ func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
 	}
 }
 
+// Update replaces the metric set, which must be an xdcr.MetricSet.
+func (m *Metrics) Update(ms common.MetricSet) error {
+	metrics, ok := ms.(MetricSet)
+	if !ok {
+		return common.WrongMetricSet(m.Name(), ms)
+	}
+	m.updateMSI(metrics)
+	return nil
+}
+
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		end := time.Now()
-		m.logger.Infow("Completed XDCR collection", zap.Duration("elapsed", end.Sub(start)))
-	}()
-	m.logger.Info("Starting XDCR collection")
+	_ = m.CollectContext(context.Background(), metrics)
+}
+
+func (m *Metrics) CollectContext(ctx context.Context, metrics chan<- prometheus.Metric) error {
+	defer m.StartCollection()()
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
+	emit := m.Emitter(metrics)
 	// cbrest doesn't let us make a request to xdcr's port, so we need to do it manually
-	data, err := m.doXDCRRequest("/pools/default/replications")
+	data, err := m.doXDCRRequest(ctx, "/pools/default/replications")
 	if err != nil {
-		m.logger.Errorw("Failed to get replications data", "error", err)
-		return
+		m.Logger.Errorw("Failed to get replications data", "error", err)
+		emit.Error(err)
+		return emit.Err()
 	}
 
 	var replicationsData []struct {
 		SourceBucket string `json:"source"`
 	}
 	if err := json.Unmarshal(data, &replicationsData); err != nil {
-		m.logger.Errorw("Failed to parse configured replications", "error", err)
-		return
+		m.Logger.Errorw("Failed to parse configured replications", "error", err)
+		emit.Error(err)
+		return emit.Err()
 	}
 
 	allSourceBuckets := make(map[string]struct{})
 	for _, replication := range replicationsData {
+		if !m.BucketAllowed(replication.SourceBucket) {
+			continue
+		}
 		allSourceBuckets[replication.SourceBucket] = struct{}{}
 	}
 
 	for bucket := range allSourceBuckets {
-		m.processStatsForReplication(bucket, metrics)
+		m.processStatsForReplication(ctx, bucket, emit)
 	}
+	return emit.Err()
 }
 
-func (m *Metrics) processStatsForReplication(sourceBucket string, metrics chan<- prometheus.Metric) {
-	body, err := m.doXDCRRequest("/stats/buckets/" + sourceBucket)
+func (m *Metrics) processStatsForReplication(ctx context.Context, sourceBucket string, emit common.Emitter) {
+	body, err := m.doXDCRRequest(ctx, "/stats/buckets/"+sourceBucket)
 	if err != nil {
-		m.logger.Errorw("failed to get stats for %s: %w", sourceBucket, err)
+		m.Logger.Errorw("Failed to get replication stats", "bucket", sourceBucket, "error", err)
+		emit.Error(err)
 		return
 	}
 
 	var stats map[string]map[string]float64
 	if err := json.Unmarshal(body, &stats); err != nil {
-		m.logger.Warnw("Failed to parse stats", "error", err)
+		m.Logger.Warnw("Failed to parse stats", "error", err)
 		return
 	}
 	for key, data := range stats {
-		m.logger.Debugw("Beginning metrics map", "statsGroup", key)
+		m.Logger.Debugw("Beginning metrics map", "statsGroup", key)
 		// Key will be in the format `remote_uuid/source_bucket/remote_bucket`
 		// If this is a backfill pipeline, the UUID will be prefixed with `backfill_`.
 		parts := strings.Split(key, "/")
 		if len(parts) != 3 {
-			m.logger.Warnw("Unexpected XDCR replication key", "key", key)
+			m.Logger.Warnw("Unexpected XDCR replication key", "key", key)
 			continue
 		}
 		backfill := false
@@ -131,11 +187,11 @@ func (m *Metrics) processStatsForReplication(sourceBucket string, metrics chan<-
 		for prometheusName, metric := range m.msi {
 			value, ok := data[metric.Name]
 			if !ok {
-				m.logger.Infow("Did not find XDCR metric for requested", "prometheusName", prometheusName, "statsGroup", key, "xdcrName", metric.Name)
+				m.Logger.Infow("Did not find XDCR metric for requested", "prometheusName", prometheusName, "statsGroup", key, "xdcrName", metric.Name)
 				continue
 			}
-			m.logger.Debugw("Mapped metric", "xdcrName", metric.Name, "desc", metric.desc, "type", metric.Type, "statsGroup", key, "labels", labels, "value", value)
-			metrics <- prometheus.MustNewConstMetric(metric.desc, metric.Type.ToPrometheus(), value, labels...)
+			m.Logger.Debugw("Mapped metric", "xdcrName", metric.Name, "desc", metric.desc, "type", metric.Type, "statsGroup", key, "labels", labels, "value", value)
+			emit.TypedMetric(metric.desc, metric.Type, value, labels...)
 		}
 	}
 }
@@ -147,9 +203,10 @@ func (m *Metrics) updateMSI(ms MetricSet) {
 	for key, metric := range ms {
 		existing, ok := m.msi[key]
 		if !ok {
+			metric.Type = common.ResolveType(key, metric.Type)
 			existing = &metricInternal{
 				Metric: metric,
-				desc:   prometheus.NewDesc(key, metric.Help, labelNames, nil),
+				desc:   prometheus.NewDesc(key, common.ResolveHelp(key, metric.Help), labelNames, nil),
 			}
 		}
 		m.msi[key] = existing
@@ -162,23 +219,23 @@ func (m *Metrics) updateMSI(ms MetricSet) {
 	}
 }
 
-func (m *Metrics) doXDCRRequest(endpoint string) ([]byte, error) {
+func (m *Metrics) doXDCRRequest(ctx context.Context, endpoint string) ([]byte, error) {
 	scheme := "http://"
-	if m.node.RestClient().TLS() {
+	if m.Node.RestClient().TLS() {
 		scheme = "https://"
 	}
 
 	// The XDCR admin API binds to 127.0.0.1, so we can't use the host from cbrest, because that'll only be
 	// localhost in a single-node cluster.
 	// main.go ensures that XDCR doesn't start unless the host is localhost, so this is safe.
-	xdcrURLPrefix := scheme + "localhost" + ":" + strconv.Itoa(xdcrRestPort)
+	xdcrURLPrefix := scheme + "localhost" + ":" + strconv.Itoa(m.RESTPort)
 
 	url := xdcrURLPrefix + endpoint
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create XDCR request to %s: %w", url, err)
 	}
-	req.SetBasicAuth(m.node.Credentials())
+	req.SetBasicAuth(m.Node.Credentials())
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform XDCR request to %s: %w", url, err)
@@ -188,5 +245,6 @@ func (m *Metrics) doXDCRRequest(endpoint string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read data from %s: %w", url, err)
 	}
+	m.RecordREST(common.ServiceXDCR, endpoint, payload)
 	return payload, nil
 }
@@ -0,0 +1,112 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// FromMetricFamilies converts gathered metrics into series of one sample each, in the same way as Prometheus does when
+// scraping them: histograms and summaries become `_bucket` (or quantile), `_sum` and `_count` series. Samples without
+// their own timestamp get now, in milliseconds since the Unix epoch. externalLabels are added to every series, unless it
+// already has a label of the same name.
+func FromMetricFamilies(mfs []*dto.MetricFamily, externalLabels map[string]string, now int64) []TimeSeries {
+	var series []TimeSeries
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, metric := range mf.GetMetric() {
+			timestamp := now
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...Label) {
+				labels := make([]Label, 0, len(metric.GetLabel())+len(extra)+len(externalLabels)+1)
+				labels = append(labels, Label{Name: "__name__", Value: name})
+				for _, pair := range metric.GetLabel() {
+					labels = append(labels, Label{Name: pair.GetName(), Value: pair.GetValue()})
+				}
+				labels = append(labels, extra...)
+				series = append(series, TimeSeries{
+					Labels:  withExternalLabels(labels, externalLabels),
+					Samples: []Sample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add(name, quantile.GetValue(), Label{Name: "quantile", Value: formatFloat(quantile.GetQuantile())})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				inf := false
+				for _, bucket := range histogram.GetBucket() {
+					inf = inf || math.IsInf(bucket.GetUpperBound(), 1)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()),
+						Label{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+				}
+				if !inf {
+					add(name+"_bucket", float64(histogram.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+				}
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func withExternalLabels(labels []Label, externalLabels map[string]string) []Label {
+	has := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		has[label.Name] = true
+	}
+	for name, value := range externalLabels {
+		if !has[name] {
+			labels = append(labels, Label{Name: name, Value: value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// formatFloat formats le and quantile label values in the same way as the Prometheus text format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
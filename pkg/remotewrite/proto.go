@@ -0,0 +1,176 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The remote write protocol's messages are few and small, so they are encoded by hand rather than generated, to avoid
+// depending on the whole of Prometheus for its prompb package. The field numbers are from prompb's remote.proto and
+// types.proto.
+const (
+	fieldWriteRequestTimeseries = 1
+	fieldTimeSeriesLabels       = 1
+	fieldTimeSeriesSamples      = 2
+	fieldLabelName              = 1
+	fieldLabelValue             = 2
+	fieldSampleValue            = 1
+	fieldSampleTimestamp        = 2
+)
+
+// TimeSeries is a series and its samples, as in a remote write request. Labels include `__name__`, and are sorted by
+// name.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value float64
+	// Timestamp is in milliseconds since the Unix epoch.
+	Timestamp int64
+}
+
+// MarshalWriteRequest encodes a remote write WriteRequest of series, without compression.
+func MarshalWriteRequest(series []TimeSeries) []byte {
+	var b, ts []byte
+	for _, s := range series {
+		ts = s.appendTo(ts[:0])
+		b = protowire.AppendTag(b, fieldWriteRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+func (s TimeSeries) appendTo(b []byte) []byte {
+	for _, label := range s.Labels {
+		var l []byte
+		l = protowire.AppendTag(l, fieldLabelName, protowire.BytesType)
+		l = protowire.AppendString(l, label.Name)
+		l = protowire.AppendTag(l, fieldLabelValue, protowire.BytesType)
+		l = protowire.AppendString(l, label.Value)
+		b = protowire.AppendTag(b, fieldTimeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+	for _, sample := range s.Samples {
+		var m []byte
+		m = protowire.AppendTag(m, fieldSampleValue, protowire.Fixed64Type)
+		m = protowire.AppendFixed64(m, math.Float64bits(sample.Value))
+		m = protowire.AppendTag(m, fieldSampleTimestamp, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(sample.Timestamp))
+		b = protowire.AppendTag(b, fieldTimeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b
+}
+
+// UnmarshalWriteRequest decodes the series of an uncompressed remote write WriteRequest, ignoring any other fields,
+// such as metadata. It is the counterpart of MarshalWriteRequest, for receiving pushes in tests.
+func UnmarshalWriteRequest(b []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != fieldWriteRequestTimeseries || typ != protowire.BytesType {
+			return nil
+		}
+		var s TimeSeries
+		err := consumeFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			switch {
+			case num == fieldTimeSeriesLabels && typ == protowire.BytesType:
+				label, err := unmarshalLabel(value)
+				s.Labels = append(s.Labels, label)
+				return err
+			case num == fieldTimeSeriesSamples && typ == protowire.BytesType:
+				sample, err := unmarshalSample(value)
+				s.Samples = append(s.Samples, sample)
+				return err
+			}
+			return nil
+		})
+		series = append(series, s)
+		return err
+	})
+	return series, err
+}
+
+func unmarshalLabel(b []byte) (Label, error) {
+	var label Label
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == fieldLabelName && typ == protowire.BytesType:
+			label.Name = string(value)
+		case num == fieldLabelValue && typ == protowire.BytesType:
+			label.Value = string(value)
+		}
+		return nil
+	})
+	return label, err
+}
+
+func unmarshalSample(b []byte) (Sample, error) {
+	var sample Sample
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == fieldSampleValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			sample.Value = math.Float64frombits(v)
+		case num == fieldSampleTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			sample.Timestamp = int64(v)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// consumeFields calls fn with each field of the message b. For length-delimited fields, value is the field's content,
+// otherwise it is the encoded value.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+		}
+		value := b[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package remotewrite pushes the exporter's metrics to a Prometheus-compatible backend with the remote write protocol
+// (https://prometheus.io/docs/concepts/remote_write_spec/), for clusters that Prometheus can't reach to scrape.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/couchbaselabs/cmos-prometheus-exporter/pkg/meta"
+)
+
+// samplesPerRequest is the maximum number of samples to send in one request, as receivers limit the size of requests.
+const samplesPerRequest = 2000
+
+// Config configures a Pusher.
+type Config struct {
+	// URL is the remote write endpoint, such as `http://prometheus:9090/api/v1/write`.
+	URL string
+	// Interval is how often to gather and push the metrics.
+	Interval time.Duration
+	// Timeout is the timeout of each request.
+	Timeout time.Duration
+	// Username and Password are the basic authentication credentials to push with, if Username isn't blank.
+	Username string
+	Password string
+	// ExternalLabels are added to every series, unless it has a label of the same name.
+	ExternalLabels map[string]string
+	// QueueSize is the maximum number of requests waiting to be sent. Once it is full, the oldest request is dropped
+	// to make room for the next.
+	QueueSize int
+	// Retries is how many times to retry a request that failed with a network error, a 5xx status or a 429 status.
+	Retries int
+	// RetryBackoff is the wait before the first retry of a request, which doubles for each retry after. It defaults
+	// to a second.
+	RetryBackoff time.Duration
+}
+
+// Pusher gathers metrics on an interval and pushes them with the remote write protocol. It is a prometheus.Collector
+// of its own self-metrics.
+type Pusher struct {
+	cfg      Config
+	logger   *zap.SugaredLogger
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	queue    chan []TimeSeries
+
+	samples     *prometheus.CounterVec
+	queueLength prometheus.GaugeFunc
+	lastSuccess prometheus.Gauge
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// retryableError is an error that is worth retrying the request after.
+type retryableError struct {
+	error
+}
+
+// NewPusher starts pushing the metrics of gatherer. Close must be called to stop it.
+func NewPusher(logger *zap.SugaredLogger, gatherer prometheus.Gatherer, cfg Config) (*Pusher, error) {
+	parsed, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote write URL: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid remote write URL %q: the scheme must be http or https", cfg.URL)
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid remote write interval %s", cfg.Interval)
+	}
+	if cfg.QueueSize <= 0 {
+		return nil, fmt.Errorf("invalid remote write queue size %d", cfg.QueueSize)
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	p := &Pusher{
+		cfg:      cfg,
+		logger:   logger,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan []TimeSeries, cfg.QueueSize),
+		samples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmos_exporter_remote_write_samples_total",
+			Help: "Number of samples pushed with remote write, by result: sent, failed (after any retries), or dropped " +
+				"(because the queue was full)",
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cmos_exporter_remote_write_last_success_timestamp_seconds",
+			Help: "Unix time of the last remote write request that succeeded",
+		}),
+	}
+	p.queueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cmos_exporter_remote_write_queue_length",
+		Help: "Number of remote write requests waiting to be sent",
+	}, func() float64 {
+		return float64(len(p.queue))
+	})
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Add(2)
+	go p.gatherLoop(ctx)
+	go p.sendLoop(ctx)
+	return p, nil
+}
+
+// Close stops pushing. Requests still in the queue are dropped.
+func (p *Pusher) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Pusher) Describe(descs chan<- *prometheus.Desc) {
+	p.samples.Describe(descs)
+	p.queueLength.Describe(descs)
+	p.lastSuccess.Describe(descs)
+}
+
+func (p *Pusher) Collect(metrics chan<- prometheus.Metric) {
+	p.samples.Collect(metrics)
+	p.queueLength.Collect(metrics)
+	p.lastSuccess.Collect(metrics)
+}
+
+func (p *Pusher) gatherLoop(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.gather()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gather gathers the metrics, and queues them to be sent.
+func (p *Pusher) gather() {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		// As when serving /metrics, carry on with the metrics that were gathered.
+		p.logger.Warnw("Failed to gather some metrics", "error", err)
+	}
+	series := FromMetricFamilies(mfs, p.cfg.ExternalLabels, time.Now().UnixMilli())
+	for len(series) > 0 {
+		n := len(series)
+		if n > samplesPerRequest {
+			n = samplesPerRequest
+		}
+		p.enqueue(series[:n])
+		series = series[n:]
+	}
+}
+
+// enqueue adds a request to the queue, dropping the oldest one if it is full. It must only be called by gatherLoop.
+func (p *Pusher) enqueue(series []TimeSeries) {
+	for {
+		select {
+		case p.queue <- series:
+			return
+		default:
+		}
+		select {
+		case dropped := <-p.queue:
+			p.logger.Warnw("Remote write queue is full, dropping the oldest request", "samples", len(dropped))
+			p.samples.WithLabelValues("dropped").Add(float64(len(dropped)))
+		default:
+		}
+	}
+}
+
+func (p *Pusher) sendLoop(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case series := <-p.queue:
+			p.send(ctx, series)
+		}
+	}
+}
+
+// send sends a request, retrying if it fails with a retryable error.
+func (p *Pusher) send(ctx context.Context, series []TimeSeries) {
+	body := snappy.Encode(nil, MarshalWriteRequest(series))
+	backoff := p.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.post(ctx, body)
+		if err == nil {
+			p.samples.WithLabelValues("sent").Add(float64(len(series)))
+			p.lastSuccess.SetToCurrentTime()
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		var retryable retryableError
+		if !errors.As(err, &retryable) || attempt >= p.cfg.Retries {
+			p.logger.Errorw("Failed to push metrics", "samples", len(series), "attempts", attempt+1, "error", err)
+			p.samples.WithLabelValues("failed").Add(float64(len(series)))
+			return
+		}
+		p.logger.Warnw("Failed to push metrics, retrying", "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a remote write request. Errors that are worth retrying are retryableErrors.
+func (p *Pusher) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "cmos-prometheus-exporter/"+meta.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(message))
+	if res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests {
+		return retryableError{err}
+	}
+	return err
+}
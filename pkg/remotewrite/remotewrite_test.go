@@ -0,0 +1,242 @@
+// Copyright 2022 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package remotewrite
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// receiver is a stand-in remote write receiver, which responds to each request with the next of its statuses (and
+// 204 once they run out), and keeps the series of the requests it accepts.
+type receiver struct {
+	*httptest.Server
+	mux      sync.Mutex
+	statuses []int
+	requests atomic.Int64
+	series   []TimeSeries
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Inc()
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" ||
+			req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			http.Error(w, "bad headers", http.StatusBadRequest)
+			return
+		}
+		if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "pass" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		series, err := decodeRequest(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		status := http.StatusNoContent
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		if status == http.StatusNoContent {
+			r.series = append(r.series, series...)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func decodeRequest(req *http.Request) ([]TimeSeries, error) {
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalWriteRequest(body)
+}
+
+func (r *receiver) received() []TimeSeries {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]TimeSeries(nil), r.series...)
+}
+
+func TestMarshalWriteRequest(t *testing.T) {
+	series := []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "a"}, {Name: "bucket", Value: "default"}},
+			Samples: []Sample{{Value: 1.5, Timestamp: 1650000000000}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "b"}},
+			Samples: []Sample{{Value: math.Inf(-1), Timestamp: -1}, {Value: 0, Timestamp: 0}},
+		},
+	}
+	decoded, err := UnmarshalWriteRequest(MarshalWriteRequest(series))
+	require.NoError(t, err)
+	require.Equal(t, series, decoded)
+
+	_, err = UnmarshalWriteRequest([]byte{0x0a, 0x05, 0x01})
+	require.Error(t, err)
+}
+
+func TestFromMetricFamilies(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "Gauge"}, []string{"bucket", "zone"})
+	gauge.WithLabelValues("default", "a").Set(2)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "test_seconds", Help: "Histogram", Buckets: []float64{0.5, 1},
+	})
+	histogram.Observe(0.25)
+	histogram.Observe(2)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "test_summary", Help: "Summary", Objectives: map[float64]float64{0.5: 0.05},
+	})
+	summary.Observe(3)
+	reg.MustRegister(gauge, histogram, summary)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	labels := func(pairs ...string) []Label {
+		var result []Label
+		for i := 0; i < len(pairs); i += 2 {
+			result = append(result, Label{Name: pairs[i], Value: pairs[i+1]})
+		}
+		return result
+	}
+	sample := func(value float64) []Sample {
+		return []Sample{{Value: value, Timestamp: 1000}}
+	}
+	// The zone external label doesn't replace the series' own.
+	series := FromMetricFamilies(mfs, map[string]string{"cluster": "c1", "zone": "b"}, 1000)
+	require.Equal(t, []TimeSeries{
+		{Labels: labels("__name__", "test_gauge", "bucket", "default", "cluster", "c1", "zone", "a"), Samples: sample(2)},
+		{Labels: labels("__name__", "test_seconds_bucket", "cluster", "c1", "le", "0.5", "zone", "b"), Samples: sample(1)},
+		{Labels: labels("__name__", "test_seconds_bucket", "cluster", "c1", "le", "1", "zone", "b"), Samples: sample(1)},
+		{Labels: labels("__name__", "test_seconds_bucket", "cluster", "c1", "le", "+Inf", "zone", "b"), Samples: sample(2)},
+		{Labels: labels("__name__", "test_seconds_sum", "cluster", "c1", "zone", "b"), Samples: sample(2.25)},
+		{Labels: labels("__name__", "test_seconds_count", "cluster", "c1", "zone", "b"), Samples: sample(2)},
+		{Labels: labels("__name__", "test_summary", "cluster", "c1", "quantile", "0.5", "zone", "b"), Samples: sample(3)},
+		{Labels: labels("__name__", "test_summary_sum", "cluster", "c1", "zone", "b"), Samples: sample(3)},
+		{Labels: labels("__name__", "test_summary_count", "cluster", "c1", "zone", "b"), Samples: sample(1)},
+	}, series)
+}
+
+// testGatherer gathers a single counter.
+func testGatherer(t *testing.T) prometheus.Gatherer {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Counter"})
+	counter.Add(3)
+	reg.MustRegister(counter)
+	return reg
+}
+
+func newTestPusher(t *testing.T, url string, retries int) *Pusher {
+	t.Helper()
+	p, err := NewPusher(zap.NewNop().Sugar(), testGatherer(t), Config{
+		URL:            url,
+		Interval:       time.Hour,
+		Timeout:        time.Second,
+		Username:       "user",
+		Password:       "pass",
+		ExternalLabels: map[string]string{"cluster": "c1"},
+		QueueSize:      10,
+		Retries:        retries,
+		RetryBackoff:   time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+func TestPusherRetries(t *testing.T) {
+	r := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	p := newTestPusher(t, r.URL, 2)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.samples.WithLabelValues("sent")) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(3), r.requests.Load())
+	series := r.received()
+	require.Len(t, series, 1)
+	require.Equal(t, []Label{{Name: "__name__", Value: "test_total"}, {Name: "cluster", Value: "c1"}}, series[0].Labels)
+	require.Equal(t, float64(3), series[0].Samples[0].Value)
+	require.NotZero(t, testutil.ToFloat64(p.lastSuccess))
+}
+
+func TestPusherGivesUp(t *testing.T) {
+	// Client errors aren't retried.
+	r := newReceiver(t, http.StatusBadRequest)
+	p := newTestPusher(t, r.URL, 2)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.samples.WithLabelValues("failed")) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(1), r.requests.Load())
+
+	// Nor are server errors, once the retries are used up.
+	r = newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	p = newTestPusher(t, r.URL, 1)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.samples.WithLabelValues("failed")) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(2), r.requests.Load())
+	require.Empty(t, r.received())
+}
+
+func TestPusherQueueDropsOldest(t *testing.T) {
+	p := &Pusher{
+		logger:  zap.NewNop().Sugar(),
+		queue:   make(chan []TimeSeries, 2),
+		samples: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_samples_total"}, []string{"result"}),
+	}
+	for i := 1; i <= 4; i++ {
+		p.enqueue(make([]TimeSeries, i))
+	}
+	require.Equal(t, float64(1+2), testutil.ToFloat64(p.samples.WithLabelValues("dropped")))
+	require.Len(t, <-p.queue, 3)
+	require.Len(t, <-p.queue, 4)
+}
+
+func TestNewPusherValidates(t *testing.T) {
+	cfg := Config{URL: "ftp://example.com", Interval: time.Second, QueueSize: 1}
+	_, err := NewPusher(zap.NewNop().Sugar(), testGatherer(t), cfg)
+	require.Error(t, err)
+	cfg.URL = "http://example.com/api/v1/write"
+	cfg.Interval = 0
+	_, err = NewPusher(zap.NewNop().Sugar(), testGatherer(t), cfg)
+	require.Error(t, err)
+}